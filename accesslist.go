@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// An access list file exempts networks from IP bans or blocks them outright.
+// One rule per line; "#" starts a comment:
+//
+//	allow 10.0.0.0/8
+//	deny  203.0.113.0/24
+//	deny  198.51.100.7
+//
+// The most specific matching rule wins, and deny wins between equally
+// specific ones. The file named by ISU4_IP_ACCESS_LIST is loaded at startup
+// and again on SIGHUP.
+
+type accessRule struct {
+	prefix netip.Prefix
+	allow  bool
+}
+
+type ipAccessList struct {
+	rules []accessRule // most specific first
+}
+
+func parseIPAccessList(r io.Reader) (*ipAccessList, error) {
+	l := &ipAccessList{}
+	sc := bufio.NewScanner(r)
+	lineno := 0
+	for sc.Scan() {
+		lineno++
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 2 || (f[0] != "allow" && f[0] != "deny") {
+			return nil, fmt.Errorf("line %d: want \"allow|deny <cidr>\"", lineno)
+		}
+		var p netip.Prefix
+		var err error
+		if strings.IndexByte(f[1], '/') >= 0 {
+			p, err = netip.ParsePrefix(f[1])
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(f[1])
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		l.rules = append(l.rules, accessRule{prefix: p.Masked(), allow: f[0] == "allow"})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(l.rules, func(i, j int) bool {
+		a, b := l.rules[i], l.rules[j]
+		if a.prefix.Bits() != b.prefix.Bits() {
+			return a.prefix.Bits() > b.prefix.Bits()
+		}
+		return !a.allow && b.allow
+	})
+	return l, nil
+}
+
+// match reports whether ip is allow-listed or deny-listed.
+func (l *ipAccessList) match(ip string) (allowed, denied bool) {
+	if l == nil || len(l.rules) == 0 {
+		return false, false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false, false
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, r := range l.rules {
+		if r.prefix.Contains(addr) {
+			return r.allow, !r.allow
+		}
+	}
+	return false, false
+}
+
+var accessList atomic.Value // *ipAccessList
+
+func loadIPAccessList(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	l, err := parseIPAccessList(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	accessList.Store(l)
+	logger.Info("loaded IP access list", "path", path, "rules", len(l.rules))
+	return nil
+}
+
+func initIPAccessList() {
+	path := getEnv("ISU4_IP_ACCESS_LIST", "")
+	if path == "" {
+		return
+	}
+	must(loadIPAccessList(path))
+	onSIGHUP(func() {
+		if err := loadIPAccessList(path); err != nil {
+			logger.Error("reload IP access list", "err", err)
+		}
+	})
+}
+
+// maxDeniedHits bounds how many distinct deny-listed addresses are kept
+// for /report.
+const maxDeniedHits = 10000
+
+var (
+	deniedHitsMu sync.Mutex
+	deniedHits   = make(map[string]bool)
+)
+
+func currentIPAccessList() *ipAccessList {
+	l, _ := accessList.Load().(*ipAccessList)
+	return l
+}
+
+// checkIPAccessList matches ip against the current list and remembers
+// deny-listed hits.
+func checkIPAccessList(ip string) (allowed, denied bool) {
+	allowed, denied = currentIPAccessList().match(ip)
+	if denied {
+		deniedHitsMu.Lock()
+		if len(deniedHits) < maxDeniedHits {
+			deniedHits[ip] = true
+		}
+		deniedHitsMu.Unlock()
+	}
+	return allowed, denied
+}
+
+// deniedIPs returns the deny-listed addresses that have tried to log in.
+func deniedIPs() []string {
+	deniedHitsMu.Lock()
+	ips := make([]string, 0, len(deniedHits))
+	for ip := range deniedHits {
+		ips = append(ips, ip)
+	}
+	deniedHitsMu.Unlock()
+	sort.Strings(ips)
+	return ips
+}
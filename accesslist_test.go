@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testAccessList = `
+# office and monitoring
+allow 10.0.0.0/8
+deny  10.66.0.0/16   # except the lab
+allow 10.66.1.5
+deny  203.0.113.0/24
+deny  2001:db8:bad::/48
+`
+
+func TestIPAccessListMatch(t *testing.T) {
+	l, err := parseIPAccessList(strings.NewReader(testAccessList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ip              string
+		allowed, denied bool
+	}{
+		{"10.1.2.3", true, false},
+		{"10.66.2.3", false, true},
+		{"10.66.1.5", true, false},
+		{"::ffff:203.0.113.9", false, true},
+		{"2001:db8:bad:1::1", false, true},
+		{"192.0.2.1", false, false},
+		{"not-an-ip", false, false},
+	} {
+		allowed, denied := l.match(c.ip)
+		if allowed != c.allowed || denied != c.denied {
+			t.Errorf("match(%s) = %v, %v; want %v, %v", c.ip, allowed, denied, c.allowed, c.denied)
+		}
+	}
+
+	if _, err := parseIPAccessList(strings.NewReader("permit 10.0.0.0/8")); err == nil {
+		t.Errorf("bad verb accepted")
+	}
+	if _, err := parseIPAccessList(strings.NewReader("deny 10.0.0.0/33")); err == nil {
+		t.Errorf("bad prefix accepted")
+	}
+}
+
+func TestIPAccessListLogin(t *testing.T) {
+	l, err := parseIPAccessList(strings.NewReader(testAccessList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := currentIPAccessList()
+	accessList.Store(l)
+	defer accessList.Store(saved)
+
+	users := []*User{{ID: 1, Login: "alice", password: "secret"}}
+	withLoginEnv(users, func() {
+		if _, err := attemptLogin(loginRequest("alice", "secret", "203.0.113.7")); err != ErrBannedIP {
+			t.Errorf("deny-listed login: %v", err)
+		}
+		found := false
+		for _, ip := range deniedIPs() {
+			found = found || ip == "203.0.113.7"
+		}
+		if !found {
+			t.Errorf("deniedIPs() = %v", deniedIPs())
+		}
+
+		// Allow-listed addresses are never banned, but users still lock.
+		for i := 0; i < IPBanThreshold+5; i++ {
+			attemptLogin(loginRequest("nobody", "x", "10.1.2.3"))
+		}
+		if _, err := attemptLogin(loginRequest("alice", "secret", "10.1.2.3")); err != nil {
+			t.Errorf("allow-listed login: %v", err)
+		}
+	})
+}
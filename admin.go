@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+)
+
+// The admin listener serves /__reset__, /metrics, /password-reset and
+// /debug/pprof/. It binds to ISU4_ADMIN_ADDR, which is either host:port
+// (loopback by default) or unix:/path/to/socket. When ISU4_ADMIN_TOKEN is
+// set every request must also carry it in an X-Admin-Token header or as a
+// bearer token.
+
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/__reset__", reset)
+	mux.HandleFunc("/metrics", metrics)
+	mux.HandleFunc("/password-reset", allowMethods(issueResetToken, "POST"))
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// reset responds once queued login_log rows are written and the history has
+// been rebuilt. ISU4_RESET_MODE selects "reload" or "baseline". Reload stays
+// the default because it is the only mode that sees login_log being
+// reloaded from outside, as the benchmark does.
+func reset(w http.ResponseWriter, r *http.Request) {
+	mode := getEnv("ISU4_RESET_MODE", "reload")
+	if err := resetLogins(mode); err != nil {
+		logger.Error("reset failed", "mode", mode, "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	securityEvent("reset", "mode", mode)
+	w.Write([]byte("OK"))
+}
+
+func adminAuth(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.Header.Get("X-Admin-Token")
+		if auth := r.Header.Get("Authorization"); got == "" && strings.HasPrefix(auth, "Bearer ") {
+			got = auth[len("Bearer "):]
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func listenAdmin(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		os.Remove(path)
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func serveAdmin() {
+	addr := getEnv("ISU4_ADMIN_ADDR", "127.0.0.1:8081")
+	l, err := listenAdmin(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger.Info("starting admin listener", "addr", addr)
+	h := adminAuth(getEnv("ISU4_ADMIN_TOKEN", ""), newAdminMux())
+	log.Fatal(http.Serve(l, accessLog(h)))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminRoutesNotPublic(t *testing.T) {
+	mux := newPublicMux()
+	for _, path := range []string{
+		"/__reset__",
+		"/metrics",
+		"/debug/pprof/",
+		"/debug/pprof/cmdline",
+		"/debug/pprof/heap",
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", path, rec.Code)
+		}
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := adminAuth("secret", ok)
+
+	for _, c := range []struct {
+		header, value string
+		code          int
+	}{
+		{"", "", http.StatusForbidden},
+		{"X-Admin-Token", "wrong", http.StatusForbidden},
+		{"X-Admin-Token", "secret", http.StatusOK},
+		{"Authorization", "Bearer secret", http.StatusOK},
+		{"Authorization", "secret", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("GET", "/__reset__", nil)
+		if c.header != "" {
+			req.Header.Set(c.header, c.value)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != c.code {
+			t.Errorf("%s: %q: status %d, want %d", c.header, c.value, rec.Code, c.code)
+		}
+	}
+}
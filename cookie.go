@@ -6,14 +6,19 @@ import (
 	"encoding/hex"
 	"net/http"
 	"sync"
+	"time"
 )
 
 const sessionName = "isucon_session"
 
 type Session struct {
-	UserId int
-	Key    string
-	Notice string
+	UserId    int
+	Key       string
+	Notice    string
+	MFAUserId int    // user who gave the password but not yet the one-time code
+	MFASecret string // base32 TOTP secret being enrolled
+
+	mfaExpires time.Time
 }
 
 type SessionStore struct {
@@ -49,10 +54,50 @@ func (self *SessionStore) Set(w http.ResponseWriter, sess *Session) {
 		sess.Key = key
 	}
 
-	cookie := sessions.NewCookie(sessionName, key, &sessions.Options{})
+	cookie := sessions.NewCookie(sessionName, key, &sessions.Options{Secure: cookieSecure})
+	cookie.SameSite = cookieSameSite
 	http.SetCookie(w, cookie)
 
 	self.Lock()
 	self.store[key] = sess
 	self.Unlock()
 }
+
+// DropUser ends every session of userId, logged in or half way through
+// MFA, except the one with key keep.
+func (self *SessionStore) DropUser(userId int, keep string) {
+	self.Lock()
+	for key, s := range self.store {
+		if key != keep && (s.UserId == userId || s.MFAUserId == userId) {
+			delete(self.store, key)
+		}
+	}
+	self.Unlock()
+}
+
+func (self *SessionStore) Len() int {
+	self.Lock()
+	n := len(self.store)
+	self.Unlock()
+	return n
+}
+
+// cookieSameSite keeps browsers from sending the session cookie with
+// requests other sites start.
+var cookieSameSite = http.SameSiteLaxMode
+
+// initSessions reads ISU4_COOKIE_SAMESITE: lax, strict, none or off.
+func initSessions() {
+	switch mode := getEnv("ISU4_COOKIE_SAMESITE", "lax"); mode {
+	case "lax":
+		cookieSameSite = http.SameSiteLaxMode
+	case "strict":
+		cookieSameSite = http.SameSiteStrictMode
+	case "none":
+		cookieSameSite = http.SameSiteNoneMode
+	case "off":
+		cookieSameSite = 0
+	default:
+		panic("ISU4_COOKIE_SAMESITE: unknown mode " + mode)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// With ISU4_CSRF=1 every form carries a token that must be signed for the
+// random secret in the client's isucon_csrf cookie, and posts without it are
+// rejected. Keeping the secret in a cookie rather than the session means
+// showing the login form creates no server-side state. It is off by default
+// because the benchmark posts to /login without loading the form first.
+var (
+	csrfEnabled bool
+	csrfKey     = newCSRFKey() // signs tokens; ISU4_CSRF_KEY keeps them valid across restarts
+)
+
+func initCSRF() {
+	csrfEnabled = getEnv("ISU4_CSRF", "") == "1"
+	if key := getEnv("ISU4_CSRF_KEY", ""); key != "" {
+		csrfKey = []byte(key)
+	}
+}
+
+func newCSRFKey() []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	must(err)
+	return key
+}
+
+// csrfCookieName has the __Host- prefix under TLS, so a sibling subdomain
+// cannot plant its own secret.
+func csrfCookieName() string {
+	if cookieSecure {
+		return "__Host-isucon_csrf"
+	}
+	return "isucon_csrf"
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	must(err)
+	return hex.EncodeToString(b)
+}
+
+func signCSRF(secret, nonce string) string {
+	mac := hmac.New(sha256.New, csrfKey)
+	mac.Write([]byte(secret + "." + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// cookieCSRF returns the secret in req's cookie, or "".
+func cookieCSRF(req *http.Request) string {
+	cookie, _ := req.Cookie(csrfCookieName())
+	if cookie == nil || len(cookie.Value) != 32 {
+		return ""
+	}
+	if _, err := hex.DecodeString(cookie.Value); err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// csrfToken returns a token, "nonce.mac", for a form on the page being
+// written, setting the cookie when req has none. It is "" when CSRF checks
+// are off.
+func csrfToken(w http.ResponseWriter, req *http.Request) string {
+	if !csrfEnabled {
+		return ""
+	}
+	secret := cookieCSRF(req)
+	if secret == "" {
+		secret = randomHex(16)
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookieName(),
+			Value:    secret,
+			Path:     "/",
+			Secure:   cookieSecure,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	nonce := randomHex(16)
+	return nonce + "." + signCSRF(secret, nonce)
+}
+
+// validCSRF reports whether req's form carries a token signed for the
+// secret in its cookie, or CSRF checks are off.
+func validCSRF(req *http.Request) bool {
+	if !csrfEnabled {
+		return true
+	}
+	secret := cookieCSRF(req)
+	nonce, mac, ok := strings.Cut(req.PostFormValue("csrf_token"), ".")
+	return secret != "" && ok && hmac.Equal([]byte(mac), []byte(signCSRF(secret, nonce)))
+}
+
+// checkCSRF rejects posts failing validCSRF with 403 before h runs, so a
+// forged form neither counts as a login attempt nor uses up rate limits.
+func checkCSRF(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !validCSRF(req) {
+			securityEvent("csrf_rejected", "path", req.URL.Path, "ip", clientIP(req))
+			errorPage(w, http.StatusForbidden)
+			return
+		}
+		h(w, req)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var csrfInputRe = regexp.MustCompile(`name="csrf_token" value="([0-9a-f.]+)"`)
+
+func withCSRF(on bool, f func()) {
+	saved := csrfEnabled
+	csrfEnabled = on
+	defer func() { csrfEnabled = saved }()
+	f()
+}
+
+// loadForm gets the login form and returns its CSRF cookie and token.
+func loadForm(t *testing.T, mux http.Handler) (*http.Cookie, string) {
+	w := serve(mux, "GET", "/")
+	m := csrfInputRe.FindStringSubmatch(w.Body.String())
+	cookies := w.Result().Cookies()
+	if m == nil || len(cookies) == 0 {
+		t.Fatalf("no token or cookie in the form:\n%s", w.Body)
+	}
+	return cookies[0], m[1]
+}
+
+func postLogin(mux http.Handler, cookie *http.Cookie, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "192.0.2.1:1234"
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func TestCSRF(t *testing.T) {
+	loadTestTemplates(t)
+	mux := newPublicMux()
+	withCSRF(true, func() {
+		withLoginEnv([]*User{{ID: 1, Login: "alice", password: "pw"}}, func() {
+			sessions := sessionStore.Len()
+			cookie, token := loadForm(t, mux)
+			otherCookie, otherToken := loadForm(t, mux)
+			if token == otherToken {
+				t.Fatal("forms share a token")
+			}
+			if n := sessionStore.Len(); n != sessions {
+				t.Errorf("showing the form created %d sessions", n-sessions)
+			}
+			nonce := strings.SplitN(token, ".", 2)[0]
+			planted := &http.Cookie{Name: csrfCookieName(), Value: strings.Repeat("0", 32)}
+
+			for _, c := range []struct {
+				name   string
+				cookie *http.Cookie
+				token  string
+			}{
+				{"no token", cookie, ""},
+				{"wrong token", cookie, "0123456789abcdef0123456789abcdef"},
+				{"other form's token", cookie, otherToken},
+				{"no cookie", nil, token},
+				{"bad signature", cookie, nonce + "." + strings.Repeat("0", 64)},
+				{"other client's cookie", planted, token},
+				{"cookie secret as token", cookie, cookie.Value},
+			} {
+				w := postLogin(mux, c.cookie, url.Values{"login": {"alice"}, "password": {"x"}, "csrf_token": {c.token}})
+				if w.Code != http.StatusForbidden {
+					t.Errorf("%s: %d", c.name, w.Code)
+				}
+			}
+			if _, _, _, n := loginHistory.Size(); n != 0 {
+				t.Fatalf("%d rejected posts recorded as attempts", n)
+			}
+
+			w := postLogin(mux, cookie, url.Values{"login": {"alice"}, "password": {"pw"}, "csrf_token": {token}})
+			if w.Code != 302 || w.Header().Get("Location") != "/mypage" {
+				t.Errorf("valid token: %d %s", w.Code, w.Header().Get("Location"))
+			}
+			w = postLogin(mux, otherCookie, url.Values{"login": {"alice"}, "password": {"x"}, "csrf_token": {otherToken}})
+			if w.Code != 302 || loginHistory.ByName("alice").failures != 1 {
+				t.Errorf("valid token, wrong password: %d", w.Code)
+			}
+		})
+	})
+}
+
+func TestCSRFOff(t *testing.T) {
+	loadTestTemplates(t)
+	mux := newPublicMux()
+	withCSRF(false, func() {
+		withLoginEnv([]*User{{ID: 1, Login: "alice", password: "pw"}}, func() {
+			if w := serve(mux, "GET", "/"); strings.Contains(w.Body.String(), "csrf_token") || len(w.Result().Cookies()) != 0 {
+				t.Error("form carries a token with CSRF off")
+			}
+			if w := postLogin(mux, nil, url.Values{"login": {"alice"}, "password": {"pw"}}); w.Code != 302 {
+				t.Errorf("post without token: %d", w.Code)
+			}
+		})
+	})
+}
+
+func TestCSRFBeforeRateLimit(t *testing.T) {
+	loadTestTemplates(t)
+	saved := loginRateByIP
+	loginRateByIP = newRateLimiter(0, 1, 100)
+	defer func() { loginRateByIP = saved }()
+	mux := newPublicMux()
+	withCSRF(true, func() {
+		withLoginEnv([]*User{{ID: 1, Login: "alice", password: "pw"}}, func() {
+			cookie, token := loadForm(t, mux)
+			for i := 0; i < 3; i++ {
+				if w := postLogin(mux, nil, url.Values{"login": {"alice"}, "password": {"pw"}}); w.Code != http.StatusForbidden {
+					t.Fatalf("forged post %d: %d", i, w.Code)
+				}
+			}
+			w := postLogin(mux, cookie, url.Values{"login": {"alice"}, "password": {"pw"}, "csrf_token": {token}})
+			if w.Header().Get("Location") != "/mypage" {
+				t.Errorf("forged posts used up the rate limit: %d", w.Code)
+			}
+		})
+	})
+}
+
+func TestSessionCookieSameSite(t *testing.T) {
+	w := httptest.NewRecorder()
+	sessionStore.Set(w, &Session{})
+	if c := w.Result().Cookies()[0]; c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("SameSite = %v", c.SameSite)
+	}
+	if !strings.Contains(w.Header().Get("Set-Cookie"), "SameSite=Lax") {
+		t.Errorf("Set-Cookie = %q", w.Header().Get("Set-Cookie"))
+	}
+}
+
+func TestCSRFHostCookieWithTLS(t *testing.T) {
+	saved := cookieSecure
+	defer func() { cookieSecure = saved }()
+	withCSRF(true, func() {
+		for _, c := range []struct {
+			secure bool
+			name   string
+		}{{false, "isucon_csrf"}, {true, "__Host-isucon_csrf"}} {
+			cookieSecure = c.secure
+			w := httptest.NewRecorder()
+			csrfToken(w, httptest.NewRequest("GET", "/", nil))
+			cookie := w.Result().Cookies()[0]
+			if cookie.Name != c.name || cookie.Secure != c.secure || cookie.Path != "/" || cookie.Domain != "" {
+				t.Errorf("cookieSecure %v: %+v", c.secure, cookie)
+			}
+		}
+	})
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"database/sql"
 	"errors"
-	"log"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 )
@@ -14,73 +14,267 @@ var (
 	ErrLockedUser    = errors.New("Locked user")
 	ErrUserNotFound  = errors.New("Not found user")
 	ErrWrongPassword = errors.New("Wrong password")
+	// ErrMFARequired means the password was right but the login waits for
+	// a one-time code. Nothing is recorded until the code is checked.
+	ErrMFARequired = errors.New("One-time code required")
+	// errUnrecorded is what an Attempt decision returns when the check
+	// passed but is not itself a login, like the current password of a
+	// change.
+	errUnrecorded = errors.New("Not recorded")
 )
 
+// passwordResetIP is the address of the login_log rows recording password
+// resets. Not being an address, it keeps the row from clearing any
+// address's or network's failures, and a reset never becomes a last login.
+const passwordResetIP = "password-reset"
+
 type UserLogin struct {
 	Id        int
 	Ip        string
 	Login     string
 	Success   bool
 	CreatedAt time.Time
+
+	rowId int64 // login_log.id once written, 0 if the insert failed
 }
 
-type LoginHistory struct {
-	sync.RWMutex
-	byName map[string][]*UserLogin
-	byAddr map[string][]*UserLogin
+var loginHistory = NewLoginHistory()
+
+// loginGate is held for reading by every login attempt from its checks until
+// its login_log row is queued, and for writing by a reset or while a
+// snapshot copies the history.
+var loginGate sync.RWMutex
+
+// insertTracker follows rows from createLoginLog to the database, so a
+// snapshot can tell which rows its copy of the history holds without
+// keeping logins out while they are written.
+type insertTracker struct {
+	sync.Mutex
+	cond    sync.Cond
+	pending map[*UserLogin]bool
+	maxId   int64 // largest login_log.id written so far
 }
 
-func NewLoginHistory() *LoginHistory {
-	return &LoginHistory{
-		byName: make(map[string][]*UserLogin),
-		byAddr: make(map[string][]*UserLogin),
-	}
+func newInsertTracker() *insertTracker {
+	t := &insertTracker{pending: make(map[*UserLogin]bool)}
+	t.cond.L = &t.Mutex
+	return t
 }
 
-func (h *LoginHistory) ByName(name string) []*UserLogin {
-	h.RLock()
-	r := h.byName[name]
-	h.RUnlock()
-	return r
+var inserts = newInsertTracker()
+
+func (t *insertTracker) queued(l *UserLogin) {
+	t.Lock()
+	t.pending[l] = true
+	t.Unlock()
 }
 
-func (h *LoginHistory) ByAddr(addr string) []*UserLogin {
-	h.RLock()
-	r := h.byAddr[addr]
-	h.RUnlock()
-	return r
+// written records that l was inserted as row id, or failed when id is 0.
+func (t *insertTracker) written(l *UserLogin, id int64) {
+	t.Lock()
+	l.rowId = id
+	if id > t.maxId {
+		t.maxId = id
+	}
+	delete(t.pending, l)
+	t.cond.Broadcast()
+	t.Unlock()
 }
 
-func (h *LoginHistory) Add(login *UserLogin) {
-	h.Lock()
-	h.add(login)
-	h.Unlock()
+// reset sets the largest id after login_log was reloaded or truncated.
+func (t *insertTracker) reset(maxId int64) {
+	t.Lock()
+	t.maxId = maxId
+	t.Unlock()
 }
 
-func (h *LoginHistory) add(login *UserLogin) {
-	h.byName[login.Login] = append(h.byName[login.Login], login)
-	h.byAddr[login.Ip] = append(h.byAddr[login.Ip], login)
+// mark returns the largest id written so far and the rows still on their
+// way. Every row with a smaller id is already written or among them.
+func (t *insertTracker) mark() (int64, []*UserLogin) {
+	t.Lock()
+	defer t.Unlock()
+	rows := make([]*UserLogin, 0, len(t.pending))
+	for l := range t.pending {
+		rows = append(rows, l)
+	}
+	return t.maxId, rows
 }
 
-var loginHistory *LoginHistory
+// wait blocks until rows are written and returns the ids of those after
+// lastId.
+func (t *insertTracker) wait(rows []*UserLogin, lastId int64) []int64 {
+	t.Lock()
+	defer t.Unlock()
+	var ids []int64
+	for _, l := range rows {
+		for t.pending[l] {
+			t.cond.Wait()
+		}
+		if l.rowId > lastId {
+			ids = append(ids, l.rowId)
+		}
+	}
+	return ids
+}
 
-func initLogins() {
-	loginHistory = NewLoginHistory()
+// drain blocks until every queued row is written.
+func (t *insertTracker) drain() {
+	t.Lock()
+	for len(t.pending) > 0 {
+		t.cond.Wait()
+	}
+	t.Unlock()
+}
 
-	rows, err := db.Query("SELECT `user_id`, `ip`, `login`, `succeeded`, `created_at` FROM login_log")
-	must(err)
+// baseline is a snapshot of the history at startup. In "baseline" reset
+// mode rows after baselineMaxId are deleted and the history is restored from
+// it without a full reload.
+var (
+	baseline      []byte
+	baselineMaxId int64
+)
+
+// readLoginLog returns the rows of login_log after afterId, except those in
+// skip, in id order and the largest id seen.
+func readLoginLog(afterId int64, skip []int64) ([]*UserLogin, int64, error) {
+	skipped := make(map[int64]bool, len(skip))
+	for _, id := range skip {
+		skipped[id] = true
+	}
+	rows, err := db.Query("SELECT `id`, `user_id`, `ip`, `login`, `succeeded`, `created_at` FROM login_log WHERE `id` > ? ORDER BY `id`", afterId)
+	if err != nil {
+		return nil, 0, err
+	}
 	defer rows.Close()
+
+	var logins []*UserLogin
+	maxId := afterId
 	for rows.Next() {
 		var id sql.NullInt64
 		login := &UserLogin{}
-		err := rows.Scan(&id, &login.Ip, &login.Login, &login.Success, &login.CreatedAt)
+		err := rows.Scan(&maxId, &id, &login.Ip, &login.Login, &login.Success, &login.CreatedAt)
+		if err != nil {
+			return nil, 0, err
+		}
+		if skipped[maxId] {
+			continue
+		}
 		if id.Valid {
 			login.Id = int(id.Int64)
 		}
-		//log.Printf("%+v", login)
-		must(err)
-		loginHistory.Add(login)
+		// Rows written before addresses were normalized are counted with
+		// the ones written since.
+		login.Ip = normalizeIP(login.Ip)
+		logins = append(logins, login)
 	}
+	return logins, maxId, rows.Err()
+}
+
+// lastRow returns the login and created_at of row id, which identify it in
+// a snapshot.
+func lastRow(id int64) (string, int64, error) {
+	var login string
+	var at time.Time
+	err := db.QueryRow("SELECT `login`, `created_at` FROM login_log WHERE `id` = ?", id).Scan(&login, &at)
+	return login, at.Unix(), err
+}
+
+// loadSnapshot returns the history stored at path and the rows it holds, or
+// an empty one when there is no usable snapshot.
+func loadSnapshot(path string) (*LoginHistory, snapshotPos) {
+	if path == "" {
+		return NewLoginHistory(), snapshotPos{}
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var h *LoginHistory
+		var pos snapshotPos
+		h, pos, err = decodeSnapshot(data)
+		// Row lastId must still be the one the snapshot saw: after a
+		// truncation or a reload of the table it is gone or another row.
+		if err == nil && pos.lastId > 0 {
+			login, at, qerr := lastRow(pos.lastId)
+			switch {
+			case qerr == sql.ErrNoRows:
+				err = errors.New("snapshot is newer than login_log")
+			case qerr != nil:
+				err = qerr
+			case login != pos.login || at != pos.at:
+				err = errors.New("login_log changed since the snapshot")
+			}
+		}
+		if err == nil {
+			logger.Info("loaded snapshot", "path", path, "last_id", pos.lastId)
+			return h, pos
+		}
+	}
+	if !os.IsNotExist(err) {
+		logger.Warn("ignoring snapshot", "path", path, "err", err)
+	}
+	return NewLoginHistory(), snapshotPos{}
+}
+
+// loadLoginHistory reads login_log, starting from the snapshot at
+// snapshotPath when there is a valid one.
+func loadLoginHistory(snapshotPath string) (*LoginHistory, int64, error) {
+	h, pos := loadSnapshot(snapshotPath)
+	logins, maxId, err := readLoginLog(pos.lastId, pos.extra)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, l := range logins {
+		h.Add(l)
+	}
+	return h, maxId, nil
+}
+
+func initLogins() {
+	snapshotPath = getEnv("ISU4_SNAPSHOT_PATH", "")
+	h, maxId, err := loadLoginHistory(snapshotPath)
+	must(err)
+	inserts.reset(maxId)
+	if getEnv("ISU4_RESET_MODE", "reload") == "baseline" {
+		baseline, baselineMaxId = encodeSnapshot(h, snapshotPos{lastId: maxId}), maxId
+	}
+	loginHistory.replace(h)
+}
+
+// resetLogins stops new attempts, waits for queued rows to reach the
+// database and then rebuilds the history. mode "baseline" truncates
+// login_log back to its startup state; any other mode reloads it. The
+// snapshot file is removed first, as it may hold rows the reset drops.
+func resetLogins(mode string) error {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	loginGate.Lock()
+	defer loginGate.Unlock()
+	inserts.drain()
+
+	if err := removeSnapshot(); err != nil {
+		return err
+	}
+	if mode == "baseline" && baseline != nil {
+		h, _, err := decodeSnapshot(baseline)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec("DELETE FROM login_log WHERE `id` > ?", baselineMaxId); err != nil {
+			return err
+		}
+		loginHistory.replace(h)
+		stuffing.reset()
+		inserts.reset(baselineMaxId)
+		return nil
+	}
+
+	h, maxId, err := loadLoginHistory("")
+	if err != nil {
+		return err
+	}
+	loginHistory.replace(h)
+	stuffing.reset()
+	inserts.reset(maxId)
+	return nil
 }
 
 var insertStmt *sql.Stmt
@@ -102,18 +296,41 @@ func initDb() {
 func inserter() {
 	for {
 		l := <-insertCh
-		_, err := insertStmt.Exec(l.CreatedAt, l.Id, l.Login, l.Ip, l.Success)
+		userId := sql.NullInt64{Int64: int64(l.Id), Valid: l.Id != 0}
+		var id int64
+		res, err := insertStmt.Exec(l.CreatedAt, userId, l.Login, l.Ip, l.Success)
+		if err == nil {
+			id, err = res.LastInsertId()
+		}
 		if err != nil {
-			log.Println(err)
+			logger.Error("insert login_log failed", "err", err, "login", l.Login, "ip", l.Ip)
 		}
+		inserts.written(l, id)
 	}
 }
 
-func createLoginLog(succeeded bool, remoteAddr, login string, user *User) error {
-	now := time.Now()
-	ul := &UserLogin{Id: user.ID, Ip: remoteAddr, Login: login, Success: succeeded, CreatedAt: now}
-	loginHistory.Add(ul)
+// createLoginLog queues the row for an attempt that has already been applied
+// to loginHistory. st holds the states right after it.
+func createLoginLog(ul *UserLogin, user *User, st attemptStates) error {
+	inserts.queued(ul)
 	insertCh <- ul
+
+	if ul.Success {
+		if user != nil && st.cleared > 0 {
+			securityEvent("user_unlocked", "login", ul.Login, "ip", ul.Ip, "failures", st.cleared)
+		}
+		return nil
+	}
+	// Report the attempt that crosses a threshold, not every one after it.
+	if user != nil && st.byName.failures == UserLockThreshold {
+		securityEvent("user_locked", "login", ul.Login, "ip", ul.Ip)
+	}
+	if st.byAddr.failures == IPBanThreshold {
+		securityEvent("ip_banned", "ip", ul.Ip, "login", ul.Login)
+	}
+	if st.byPrefix != nil && st.byPrefix.failures == PrefixBanThreshold {
+		securityEvent("prefix_banned", "prefix", banPrefix(ul.Ip), "ip", ul.Ip, "login", ul.Login)
+	}
 	return nil
 }
 
@@ -121,23 +338,7 @@ func isLockedUser(user *User) (bool, error) {
 	if user == nil {
 		return false, nil
 	}
-	hi := loginHistory.ByName(user.Login)
-	if hi == nil || len(hi) < UserLockThreshold {
-		return false, nil
-	}
-
-	c := 0
-	for i := len(hi) - 1; i >= 0; i-- {
-		h := hi[i]
-		if h.Success {
-			return false, nil
-		}
-		c++
-		if c >= UserLockThreshold {
-			return true, nil
-		}
-	}
-	return false, nil
+	return loginHistory.ByName(user.Login).failures >= UserLockThreshold, nil
 
 	//var ni sql.NullInt64
 	//row := db.QueryRow(
@@ -159,22 +360,13 @@ func isLockedUser(user *User) (bool, error) {
 }
 
 func isBannedIP(ip string) (bool, error) {
-	hi := loginHistory.ByAddr(ip)
-	if hi == nil || len(hi) < IPBanThreshold {
-		return false, nil
+	if allowed, denied := currentIPAccessList().match(ip); allowed || denied {
+		return denied, nil
 	}
-	c := 0
-	for i := len(hi) - 1; i >= 0; i-- {
-		h := hi[i]
-		if h.Success {
-			return false, nil
-		}
-		c++
-		if c >= IPBanThreshold {
-			return true, nil
-		}
+	if prefix := banPrefix(ip); prefix != "" && loginHistory.ByPrefix(prefix).failures >= PrefixBanThreshold {
+		return true, nil
 	}
-	return false, nil
+	return loginHistory.ByAddr(ip).failures >= IPBanThreshold, nil
 	//var ni sql.NullInt64
 	//row := db.QueryRow(
 	//	"SELECT COUNT(1) AS failures FROM login_log WHERE "+
@@ -193,36 +385,119 @@ func isBannedIP(ip string) (bool, error) {
 }
 
 func attemptLogin(req *http.Request) (*User, error) {
-	succeeded := false
+	loginGate.RLock()
+	defer loginGate.RUnlock()
 
 	loginName := req.PostFormValue("login")
 	password := req.PostFormValue("password")
 
-	remoteAddr := req.RemoteAddr
-	if xForwardedFor := req.Header.Get("X-Forwarded-For"); len(xForwardedFor) > 0 {
-		remoteAddr = xForwardedFor
-	}
+	remoteAddr := clientIP(req)
 
 	user := userRepository.ByName(loginName)
-	defer func() {
-		createLoginLog(succeeded, remoteAddr, loginName, user)
-	}()
+	ul := &UserLogin{Ip: remoteAddr, Login: loginName, CreatedAt: clock.Now()}
+	if user != nil {
+		ul.Id = user.ID
+	}
+
+	refuse := refuseAttempt(user, remoteAddr, ul.CreatedAt)
+	secondStep := user != nil && mfa != nil && mfa.enrolled(user.Login)
+	// Hashed before taking the history locks, as changed passwords are
+	// slow to hash.
+	rightPassword := user != nil && user.checkPassword(password)
+
+	// Deciding and recording under the same shard locks keeps concurrent
+	// attempts from all passing the check before any failure is counted.
+	st, err := loginHistory.Attempt(ul, func(st attemptStates) error {
+		if err := refuse(st); err != nil {
+			return err
+		}
+		if user == nil {
+			return ErrUserNotFound
+		}
+		if !rightPassword {
+			return ErrWrongPassword
+		}
+		if secondStep {
+			return ErrMFARequired
+		}
+		return nil
+	})
+	if err == ErrMFARequired {
+		return user, err
+	}
+	createLoginLog(ul, user, st)
+	stuffing.observe(remoteAddr, loginName, password, ul.Success, ul.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
 
-	if banned, _ := isBannedIP(remoteAddr); banned {
-		return nil, ErrBannedIP
+// refuseAttempt returns the check, run inside Attempt, that turns away an
+// attempt by user (nil when unknown) from ip before its credentials are
+// looked at.
+func refuseAttempt(user *User, ip string, now time.Time) func(st attemptStates) error {
+	allowed, denied := checkIPAccessList(ip)
+	stuffed := !allowed && stuffing.blocked(ip, now)
+	return func(st attemptStates) error {
+		if denied || stuffed {
+			return ErrBannedIP
+		}
+		if !allowed && st.byAddr.failures >= IPBanThreshold {
+			return ErrBannedIP
+		}
+		if !allowed && st.byPrefix != nil && st.byPrefix.failures >= PrefixBanThreshold {
+			return ErrBannedIP
+		}
+		if user != nil && st.byName.failures >= UserLockThreshold {
+			return ErrLockedUser
+		}
+		return nil
 	}
-	if locked, _ := isLockedUser(user); locked {
-		return nil, ErrLockedUser
+}
+
+// recordReset records a password reset of user as a successful login from
+// passwordResetIP, which clears only the user's failures, so rebuilding the
+// history from login_log agrees with it. loginGate must be read-locked.
+func recordReset(user *User) {
+	ul := &UserLogin{Id: user.ID, Ip: passwordResetIP, Login: user.Login, CreatedAt: clock.Now()}
+	st, _ := loginHistory.Attempt(ul, func(st attemptStates) error {
+		return nil
+	})
+	createLoginLog(ul, user, st)
+}
+
+// memBannedIPs returns the addresses isBannedIP rejects right now.
+func memBannedIPs() []string {
+	ips := []string{}
+	for _, ip := range loginHistory.Addrs() {
+		if banned, _ := isBannedIP(ip); banned {
+			ips = append(ips, ip)
+		}
 	}
-	if user == nil {
-		return nil, ErrUserNotFound
+	return ips
+}
+
+// memBannedPrefixes returns the networks banned as a whole.
+func memBannedPrefixes() []string {
+	prefixes := []string{}
+	for _, prefix := range loginHistory.Prefixes() {
+		if loginHistory.ByPrefix(prefix).failures >= PrefixBanThreshold {
+			prefixes = append(prefixes, prefix)
+		}
 	}
+	return prefixes
+}
 
-	if user.password != password {
-		return nil, ErrWrongPassword
+// memLockedUsers returns the logins isLockedUser rejects right now.
+func memLockedUsers() []string {
+	logins := []string{}
+	for _, name := range loginHistory.Names() {
+		if locked, _ := isLockedUser(userRepository.ByName(name)); locked {
+			logins = append(logins, name)
+		}
 	}
-	succeeded = true
-	return user, nil
+	return logins
 }
 
 func bannedIPs() []string {
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// In dev mode (ISU4_DEV=1) public/ and templates/ are polled for changes,
+// and the templates and the public mux are rebuilt from disk when anything
+// changes. Production keeps what was loaded at startup.
+var (
+	devMode       bool
+	devPoll       time.Duration
+	staticDir     = "public"
+	publicHandler atomic.Value // http.Handler
+)
+
+func initDevMode() {
+	devMode = getEnv("ISU4_DEV", "") == "1"
+	var err error
+	devPoll, err = time.ParseDuration(getEnv("ISU4_DEV_POLL", "500ms"))
+	must(err)
+}
+
+// servePublic hands req to the current public mux, so a reload swaps every
+// route at once.
+func servePublic(w http.ResponseWriter, req *http.Request) {
+	publicHandler.Load().(http.Handler).ServeHTTP(w, req)
+}
+
+// dirStamp summarizes the names, sizes and modification times of every
+// file under dirs.
+func dirStamp(dirs ...string) uint64 {
+	h := fnv.New64a()
+	for _, dir := range dirs {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				h.Write([]byte(path + "\x00error\x00"))
+				return nil
+			}
+			h.Write([]byte(path + "\x00" + strconv.FormatInt(info.Size(), 10) + "\x00" + strconv.FormatInt(info.ModTime().UnixNano(), 10) + "\x00"))
+			return nil
+		})
+	}
+	return h.Sum64()
+}
+
+// reloadDev rebuilds the public mux and parses the templates against its
+// assets, publishing nothing until both are ready. A template that fails to
+// parse keeps the previous templates, mux and asset links in place
+// together, so pages never link to fingerprints the mux does not serve.
+func reloadDev() {
+	mux, assets := buildPublicMux()
+	pages, err := parseTemplates(templateDir, assets)
+	if err != nil {
+		logger.Error("reload templates", "err", err)
+		return
+	}
+	assetURLs.Store(assets)
+	publicHandler.Store(mux)
+	pageTemplates.Store(pages)
+	logger.Info("reloaded templates and static files")
+}
+
+func watchDev() {
+	logger.Info("dev mode: watching for changes", "dirs", []string{staticDir, templateDir}, "interval", devPoll)
+	stamp := dirStamp(staticDir, templateDir)
+	for {
+		<-clock.After(devPoll)
+		if s := dirStamp(staticDir, templateDir); s != stamp {
+			stamp = s
+			reloadDev()
+		}
+	}
+}
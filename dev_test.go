@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withDevDirs runs f with public/ and templates/ copies in a temporary
+// directory.
+func withDevDirs(t *testing.T, f func(public, templates string)) {
+	dir := t.TempDir()
+	public, templates := filepath.Join(dir, "public"), filepath.Join(dir, "templates")
+	must(os.Mkdir(public, 0755))
+	must(os.Mkdir(templates, 0755))
+	files, _ := filepath.Glob("templates/*.tmpl")
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		must(err)
+		must(os.WriteFile(filepath.Join(templates, filepath.Base(file)), b, 0644))
+	}
+	savedStatic, savedTemplates := staticDir, templateDir
+	savedPages, savedHandler := pageTemplates.Load(), publicHandler.Load()
+	staticDir, templateDir = public, templates
+	defer func() {
+		staticDir, templateDir = savedStatic, savedTemplates
+		if savedPages != nil {
+			pageTemplates.Store(savedPages)
+		}
+		if savedHandler != nil {
+			publicHandler.Store(savedHandler)
+		}
+	}()
+	f(public, templates)
+}
+
+func get(path string) string {
+	w := httptest.NewRecorder()
+	servePublic(w, httptest.NewRequest("GET", path, nil))
+	return w.Body.String()
+}
+
+func TestReloadDev(t *testing.T) {
+	withDevDirs(t, func(public, templates string) {
+		css := filepath.Join(public, "site.css")
+		must(os.WriteFile(css, []byte("a{}"), 0644))
+		reloadDev()
+		if got := get("/site.css"); got != "a{}" {
+			t.Fatalf("site.css = %q", got)
+		}
+
+		stamp := dirStamp(public, templates)
+		must(os.WriteFile(css, []byte("b{color:red}"), 0644))
+		must(os.WriteFile(filepath.Join(public, "new.css"), []byte("c{}"), 0644))
+		if dirStamp(public, templates) == stamp {
+			t.Fatal("stamp unchanged")
+		}
+		reloadDev()
+		if got := get("/site.css"); got != "b{color:red}" {
+			t.Errorf("site.css = %q after reload", got)
+		}
+		if got := get("/new.css"); got != "c{}" {
+			t.Errorf("new.css = %q", got)
+		}
+
+		index := filepath.Join(templates, "index.tmpl")
+		must(os.WriteFile(index, []byte(`<p id="changed">{{ .Notice }}</p>`), 0644))
+		reloadDev()
+		if got := get("/"); !strings.Contains(got, `<p id="changed">`) {
+			t.Errorf("index not reloaded:\n%s", got)
+		}
+
+		// A broken template keeps the last good set, and the asset links
+		// still point at files the mux serves.
+		must(os.WriteFile(index, []byte(`{{ if }}`), 0644))
+		must(os.WriteFile(css, []byte("d{}"), 0644))
+		reloadDev()
+		if got := get("/"); !strings.Contains(got, `<p id="changed">`) {
+			t.Errorf("broken template replaced the good one:\n%s", got)
+		}
+		if got := get(assetURL("/site.css")); got != "b{color:red}" {
+			t.Errorf("%s = %q after a failed reload", assetURL("/site.css"), got)
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	loadTestTemplates(t)
+	h := withSecurityHeaders(newPublicMux())
+	withLoginEnv(nil, func() {
+		for _, c := range []struct {
+			method, path string
+			code         int
+		}{
+			{"GET", "/", 200},
+			{"POST", "/login", 302},
+			{"GET", "/mypage", 302},
+			{"GET", "/stylesheets/isucon-bank.css", 200},
+			{"GET", assetURL("/images/isucon-bank.png"), 200},
+			{"GET", "/nope", 404},
+			{"GET", "/login", 405},
+			{"GET", "/__reset__", 404},
+		} {
+			w := serve(h, c.method, c.path)
+			if w.Code != c.code {
+				t.Errorf("%s %s: %d, want %d", c.method, c.path, w.Code, c.code)
+			}
+			for _, want := range [][2]string{
+				{"Content-Security-Policy", defaultCSP},
+				{"X-Frame-Options", "DENY"},
+				{"X-Content-Type-Options", "nosniff"},
+				{"Referrer-Policy", "same-origin"},
+			} {
+				if got := w.Header().Get(want[0]); got != want[1] {
+					t.Errorf("%s %s: %s = %q", c.method, c.path, want[0], got)
+				}
+			}
+			if got := w.Header().Get("Strict-Transport-Security"); got != "" {
+				t.Errorf("%s %s: HSTS over plain HTTP: %q", c.method, c.path, got)
+			}
+		}
+	})
+}
+
+func TestSecurityHeadersConfig(t *testing.T) {
+	t.Setenv("ISU4_FRAME_OPTIONS", "SAMEORIGIN")
+	t.Setenv("ISU4_REFERRER_POLICY", "off")
+	saved := securityHeaders
+	securityHeaders = append(saved[:0:0], saved...)
+	savedHSTS := hstsHeader
+	defer func() { securityHeaders, hstsHeader = saved, savedHSTS }()
+	initSecurityHeaders()
+
+	h := withSecurityHeaders(newPublicMux())
+	req := httptest.NewRequest("GET", "/stylesheets/isucon-bank.css", nil)
+	req.TLS = &tls.ConnectionState{}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if got := w.Header().Get("X-Frame-Options"); got != "SAMEORIGIN" {
+		t.Errorf("X-Frame-Options = %q", got)
+	}
+	if _, ok := w.Header()["Referrer-Policy"]; ok {
+		t.Error("Referrer-Policy not dropped")
+	}
+	if got := w.Header().Get("Strict-Transport-Security"); !strings.HasPrefix(got, "max-age=") {
+		t.Errorf("HSTS over TLS = %q", got)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// loginState is all the lock, ban and last-login rules need to know about
+// one login name or address, so memory stays O(users + IPs) however many
+// attempts are recorded.
+type loginState struct {
+	failures int        // consecutive failures since the last success
+	last     *UserLogin // most recent success
+	prev     *UserLogin // the success before last
+}
+
+func (s *loginState) add(login *UserLogin) {
+	if login.Success {
+		s.failures = 0
+		if login.Ip != passwordResetIP {
+			s.prev, s.last = s.last, login
+		}
+	} else {
+		s.failures++
+	}
+}
+
+// historyShards must be a power of two.
+const historyShards = 64
+
+type historyShard struct {
+	sync.RWMutex
+	m map[string]*loginState
+}
+
+// shardedIndex spreads keys over historyShards maps so that attempts for
+// different users and addresses rarely contend on the same lock.
+type shardedIndex [historyShards]historyShard
+
+func (x *shardedIndex) init() {
+	for i := range x {
+		x[i].m = make(map[string]*loginState)
+	}
+}
+
+func (x *shardedIndex) shard(key string) *historyShard {
+	// FNV-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &x[h&(historyShards-1)]
+}
+
+func (x *shardedIndex) get(key string) loginState {
+	sh := x.shard(key)
+	sh.RLock()
+	var r loginState
+	if s := sh.m[key]; s != nil {
+		r = *s
+	}
+	sh.RUnlock()
+	return r
+}
+
+func (x *shardedIndex) keys() []string {
+	var r []string
+	for i := range x {
+		x[i].RLock()
+		for key := range x[i].m {
+			r = append(r, key)
+		}
+		x[i].RUnlock()
+	}
+	return r
+}
+
+func (x *shardedIndex) len() int {
+	n := 0
+	for i := range x {
+		x[i].RLock()
+		n += len(x[i].m)
+		x[i].RUnlock()
+	}
+	return n
+}
+
+// state returns the state for key in sh, creating it. sh must be locked.
+func (sh *historyShard) state(key string) *loginState {
+	s := sh.m[key]
+	if s == nil {
+		s = &loginState{}
+		sh.m[key] = s
+	}
+	return s
+}
+
+type LoginHistory struct {
+	byName   shardedIndex
+	byAddr   shardedIndex
+	byPrefix shardedIndex // networks from banPrefix
+	entries  int64        // attempts applied so far, updated atomically
+}
+
+func NewLoginHistory() *LoginHistory {
+	h := &LoginHistory{}
+	h.byName.init()
+	h.byAddr.init()
+	h.byPrefix.init()
+	return h
+}
+
+func (h *LoginHistory) ByName(name string) loginState {
+	return h.byName.get(name)
+}
+
+func (h *LoginHistory) ByAddr(addr string) loginState {
+	return h.byAddr.get(addr)
+}
+
+func (h *LoginHistory) ByPrefix(prefix string) loginState {
+	return h.byPrefix.get(prefix)
+}
+
+// Names returns every login name that has an attempt recorded.
+func (h *LoginHistory) Names() []string {
+	return h.byName.keys()
+}
+
+// Addrs returns every address that has an attempt recorded.
+func (h *LoginHistory) Addrs() []string {
+	return h.byAddr.keys()
+}
+
+// Prefixes returns every network that has an attempt recorded.
+func (h *LoginHistory) Prefixes() []string {
+	return h.byPrefix.keys()
+}
+
+func (h *LoginHistory) Size() (names, addrs, prefixes, entries int) {
+	return h.byName.len(), h.byAddr.len(), h.byPrefix.len(), int(atomic.LoadInt64(&h.entries))
+}
+
+// attemptStates are the states one attempt is decided on and recorded in.
+// byPrefix is nil when its address is not aggregated into a network, and
+// byAddr too for a password reset.
+type attemptStates struct {
+	byName, byAddr, byPrefix *loginState
+	cleared                  int // byName failures a success reset, set by Attempt
+}
+
+func (st attemptStates) add(login *UserLogin) {
+	st.byName.add(login)
+	if st.byAddr != nil {
+		st.byAddr.add(login)
+	}
+	if st.byPrefix != nil {
+		st.byPrefix.add(login)
+	}
+}
+
+// update calls f with the states of login's name, address and network while
+// holding their shard locks, so a check and the record that follows it
+// cannot interleave with another attempt on the same user or address. Shards
+// are always locked in name, address, prefix order.
+func (h *LoginHistory) update(login *UserLogin, f func(st attemptStates)) {
+	ns := h.byName.shard(login.Login)
+	ns.Lock()
+	defer ns.Unlock()
+	st := attemptStates{byName: ns.state(login.Login)}
+	if login.Ip != passwordResetIP {
+		as := h.byAddr.shard(login.Ip)
+		as.Lock()
+		defer as.Unlock()
+		st.byAddr = as.state(login.Ip)
+		if prefix := banPrefix(login.Ip); prefix != "" {
+			ps := h.byPrefix.shard(prefix)
+			ps.Lock()
+			defer ps.Unlock()
+			st.byPrefix = ps.state(prefix)
+		}
+	}
+	f(st)
+}
+
+// Attempt decides on login and records it in one step. decide sees the
+// states from before the attempt, which succeeds if decide returns nil.
+// Copies of the states after recording it are returned. When decide
+// returns ErrMFARequired or errUnrecorded nothing is recorded.
+func (h *LoginHistory) Attempt(login *UserLogin, decide func(st attemptStates) error) (attemptStates, error) {
+	var err error
+	var after attemptStates
+	h.update(login, func(st attemptStates) {
+		if err = decide(st); err == ErrMFARequired || err == errUnrecorded {
+			return
+		}
+		login.Success = err == nil
+		if login.Success {
+			after.cleared = st.byName.failures
+		}
+		st.add(login)
+		byName := *st.byName
+		after.byName = &byName
+		if st.byAddr != nil {
+			byAddr := *st.byAddr
+			after.byAddr = &byAddr
+		}
+		if st.byPrefix != nil {
+			byPrefix := *st.byPrefix
+			after.byPrefix = &byPrefix
+		}
+	})
+	if err == ErrMFARequired || err == errUnrecorded {
+		return after, err
+	}
+	atomic.AddInt64(&h.entries, 1)
+	return after, err
+}
+
+func (h *LoginHistory) Add(login *UserLogin) {
+	h.update(login, func(st attemptStates) {
+		st.add(login)
+	})
+	atomic.AddInt64(&h.entries, 1)
+}
+
+func (h *LoginHistory) indexes() []*shardedIndex {
+	return []*shardedIndex{&h.byName, &h.byAddr, &h.byPrefix}
+}
+
+// lockAll locks every shard in update's order, for replace and for
+// consistent snapshots.
+func (h *LoginHistory) lockAll() {
+	for _, x := range h.indexes() {
+		for i := range x {
+			x[i].Lock()
+		}
+	}
+}
+
+func (h *LoginHistory) unlockAll() {
+	for _, x := range h.indexes() {
+		for i := range x {
+			x[i].Unlock()
+		}
+	}
+}
+
+// clone copies h under its shard locks.
+func (h *LoginHistory) clone() *LoginHistory {
+	c := NewLoginHistory()
+	h.lockAll()
+	from := h.indexes()
+	for j, x := range c.indexes() {
+		for i := range x {
+			for key, st := range from[j][i].m {
+				cp := *st
+				x[i].m[key] = &cp
+			}
+		}
+	}
+	c.entries = atomic.LoadInt64(&h.entries)
+	h.unlockAll()
+	return c
+}
+
+// replace swaps in the contents of o so readers never see a half-built
+// history. o must not be used afterwards.
+func (h *LoginHistory) replace(o *LoginHistory) {
+	h.lockAll()
+	from := o.indexes()
+	for j, x := range h.indexes() {
+		for i := range x {
+			x[i].m = from[j][i].m
+		}
+	}
+	atomic.StoreInt64(&h.entries, atomic.LoadInt64(&o.entries))
+	h.unlockAll()
+}
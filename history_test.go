@@ -0,0 +1,111 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// fullHistory is the original LoginHistory, which kept every attempt and
+// scanned it backwards on each check.
+type fullHistory struct {
+	byName map[string][]*UserLogin
+	byAddr map[string][]*UserLogin
+}
+
+func (h *fullHistory) add(l *UserLogin) {
+	h.byName[l.Login] = append(h.byName[l.Login], l)
+	h.byAddr[l.Ip] = append(h.byAddr[l.Ip], l)
+}
+
+func blockedByScan(hi []*UserLogin, threshold int) bool {
+	if hi == nil || len(hi) < threshold {
+		return false
+	}
+	c := 0
+	for i := len(hi) - 1; i >= 0; i-- {
+		if hi[i].Success {
+			return false
+		}
+		c++
+		if c >= threshold {
+			return true
+		}
+	}
+	return false
+}
+
+func lastLoginByScan(hist []*UserLogin) *UserLogin {
+	if hist == nil || len(hist) < 2 {
+		return nil
+	}
+	current := false
+	for i := len(hist) - 1; i >= 0; i-- {
+		if !hist[i].Success {
+			continue
+		}
+		if current {
+			return hist[i]
+		}
+		current = true
+	}
+	return nil
+}
+
+// withHistory runs f with loginHistory and the thresholds replaced.
+func withHistory(h *LoginHistory, userLock, ipBan int, f func()) {
+	saved, savedUser, savedIP := loginHistory, UserLockThreshold, IPBanThreshold
+	loginHistory, UserLockThreshold, IPBanThreshold = h, userLock, ipBan
+	defer func() {
+		loginHistory, UserLockThreshold, IPBanThreshold = saved, savedUser, savedIP
+	}()
+	f()
+}
+
+func TestLoginHistoryMatchesFullScan(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	names := []string{"alice", "bob", "carol", "dave"}
+	addrs := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	users := make(map[string]*User)
+	for i, name := range names {
+		users[name] = &User{ID: i + 1, Login: name}
+	}
+
+	for _, th := range [][2]int{{3, 10}, {1, 1}, {2, 5}} {
+		userLock, ipBan := th[0], th[1]
+		ref := &fullHistory{byName: make(map[string][]*UserLogin), byAddr: make(map[string][]*UserLogin)}
+		h := NewLoginHistory()
+		withHistory(h, userLock, ipBan, func() {
+			for step := 0; step < 5000; step++ {
+				l := &UserLogin{
+					Login: names[r.Intn(len(names))],
+					Ip:    addrs[r.Intn(len(addrs))],
+					// Mostly failures so thresholds are actually reached.
+					Success:   r.Intn(4) == 0,
+					CreatedAt: time.Unix(int64(step), 0),
+				}
+				ref.add(l)
+				h.Add(l)
+
+				for _, name := range names {
+					locked, _ := isLockedUser(users[name])
+					if want := blockedByScan(ref.byName[name], userLock); locked != want {
+						t.Fatalf("threshold %d step %d: isLockedUser(%s) = %v, want %v", userLock, step, name, locked, want)
+					}
+					got := users[name].getLastLogin()
+					want := lastLoginByScan(ref.byName[name])
+					if (got == nil) != (want == nil) ||
+						(got != nil && (got.CreatedAt != want.CreatedAt || got.IP != want.Ip)) {
+						t.Fatalf("step %d: getLastLogin(%s) = %+v, want %+v", step, name, got, want)
+					}
+				}
+				for _, addr := range addrs {
+					banned, _ := isBannedIP(addr)
+					if want := blockedByScan(ref.byAddr[addr], ipBan); banned != want {
+						t.Fatalf("threshold %d step %d: isBannedIP(%s) = %v, want %v", ipBan, step, addr, banned, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// normalizeIP returns the canonical text form of an address, so that
+// "::ffff:192.0.2.1" and "192.0.2.1", or "2001:DB8::0:1" and "2001:db8::1",
+// are counted as the same client. Strings that are not addresses are
+// returned unchanged.
+func normalizeIP(s string) string {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return s
+	}
+	return addr.Unmap().WithZone("").String()
+}
+
+// ipPrefix returns the network of ip that is v4bits or v6bits long.
+func ipPrefix(ip string, v4bits, v6bits int) (netip.Prefix, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap().WithZone("")
+	bits := v6bits
+	if addr.Is4() {
+		bits = v4bits
+	}
+	p, err := addr.Prefix(bits)
+	return p, err == nil
+}
+
+// Failures can also be counted per network, so that rotating through a /64
+// or a /24 does not escape the ban. Full-length prefixes, the default, turn
+// aggregation off for that family.
+var (
+	banPrefixV4Bits    = 32
+	banPrefixV6Bits    = 128
+	PrefixBanThreshold int
+)
+
+func initIPBan() {
+	var err error
+	banPrefixV4Bits, err = strconv.Atoi(getEnv("ISU4_IP_BAN_PREFIX_V4", "32"))
+	must(err)
+	banPrefixV6Bits, err = strconv.Atoi(getEnv("ISU4_IP_BAN_PREFIX_V6", "128"))
+	must(err)
+	PrefixBanThreshold, err = strconv.Atoi(getEnv("ISU4_PREFIX_BAN_THRESHOLD", strconv.Itoa(IPBanThreshold)))
+	must(err)
+}
+
+// trustedProxies are the peers whose X-Forwarded-For entries clientIP
+// believes. Anyone else could put any address there.
+var trustedProxies []netip.Prefix
+
+func initTrustedProxies() {
+	trustedProxies = nil
+	for _, s := range strings.Split(getEnv("ISU4_TRUSTED_PROXIES", "127.0.0.0/8,::1/128"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		must(err)
+		trustedProxies = append(trustedProxies, p.Masked())
+	}
+}
+
+func trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// banPrefix returns the network ip is aggregated into, or "" when there is
+// none.
+func banPrefix(ip string) string {
+	p, ok := ipPrefix(ip, banPrefixV4Bits, banPrefixV6Bits)
+	if !ok || p.Bits() == p.Addr().BitLen() {
+		return ""
+	}
+	return p.String()
+}
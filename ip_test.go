@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestNormalizeIP(t *testing.T) {
+	for _, c := range [][2]string{
+		{"192.0.2.1", "192.0.2.1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"2001:DB8:0::0:1", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"unknown", "unknown"},
+	} {
+		if got := normalizeIP(c[0]); got != c[1] {
+			t.Errorf("normalizeIP(%q) = %q, want %q", c[0], got, c[1])
+		}
+	}
+}
+
+func TestPrefixBan(t *testing.T) {
+	savedV4, savedV6, savedTh := banPrefixV4Bits, banPrefixV6Bits, PrefixBanThreshold
+	banPrefixV4Bits, banPrefixV6Bits, PrefixBanThreshold = 32, 64, 10
+	defer func() {
+		banPrefixV4Bits, banPrefixV6Bits, PrefixBanThreshold = savedV4, savedV6, savedTh
+	}()
+
+	withLoginEnv(nil, func() {
+		// A new address from the same /64 for every attempt.
+		for i := 1; i <= 10; i++ {
+			ip := fmt.Sprintf("2001:db8::%x", i)
+			if _, err := attemptLogin(loginRequest("nobody", "x", ip)); err != ErrUserNotFound {
+				t.Fatalf("attempt %d from %s: %v", i, ip, err)
+			}
+		}
+		if _, err := attemptLogin(loginRequest("nobody", "x", "2001:db8::ffff")); err != ErrBannedIP {
+			t.Errorf("11th address in prefix: %v", err)
+		}
+		if banned, _ := isBannedIP("2001:db8::1234"); !banned {
+			t.Errorf("isBannedIP for address in banned prefix = false")
+		}
+		if _, err := attemptLogin(loginRequest("nobody", "x", "2001:db8:1::1")); err != ErrUserNotFound {
+			t.Errorf("other /64: %v", err)
+		}
+		if got := memBannedPrefixes(); len(got) != 1 || got[0] != "2001:db8::/64" {
+			t.Errorf("memBannedPrefixes() = %v", got)
+		}
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	saved := trustedProxies
+	defer func() { trustedProxies = saved }()
+	trustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	for _, c := range []struct {
+		remote, xff, want string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"[::ffff:192.0.2.1]:1234", "", "192.0.2.1"},
+		// Only trusted proxies may name the client.
+		{"192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		// A client cannot hide behind entries it made up itself.
+		{"10.0.0.1:1234", "203.0.113.9, 198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "203.0.113.9, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remote
+		if c.xff != "" {
+			req.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if got := clientIP(req); got != c.want {
+			t.Errorf("%s via %q: %s, want %s", c.remote, c.xff, got, c.want)
+		}
+	}
+}
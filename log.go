@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logger is the application log. accessLogger and securityLogger are
+// separate streams so they can be shipped to their own files; the access log
+// is nil when disabled. initLogging replaces the defaults below.
+var (
+	logger         = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	accessLogger   *slog.Logger
+	securityLogger = logger.With("stream", "security")
+)
+
+func initLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getEnv("ISU4_LOG_LEVEL", "info"))); err != nil {
+		panic(err)
+	}
+	maxSize, err := strconv.ParseInt(getEnv("ISU4_LOG_MAX_SIZE", "100"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+	keep, err := strconv.Atoi(getEnv("ISU4_LOG_KEEP", "5"))
+	if err != nil {
+		panic(err)
+	}
+	useJSON := getEnv("ISU4_LOG_FORMAT", "text") == "json"
+
+	newLogger := func(w io.Writer) *slog.Logger {
+		opts := &slog.HandlerOptions{Level: level}
+		if useJSON {
+			return slog.New(slog.NewJSONHandler(w, opts))
+		}
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	// "" disables the stream, "-" writes it to stderr and anything else
+	// is a file rotated after ISU4_LOG_MAX_SIZE megabytes.
+	open := func(path string) *slog.Logger {
+		switch path {
+		case "":
+			return nil
+		case "-":
+			return newLogger(os.Stderr)
+		}
+		f, err := openRotatingFile(path, maxSize<<20, keep)
+		if err != nil {
+			panic(err)
+		}
+		return newLogger(f)
+	}
+
+	logger = newLogger(os.Stderr)
+	accessLogger = open(getEnv("ISU4_ACCESS_LOG", ""))
+	securityLogger = open(getEnv("ISU4_SECURITY_LOG", ""))
+	if securityLogger == nil {
+		securityLogger = logger.With("stream", "security")
+	}
+}
+
+// securityEvent records lockouts, bans, resets and login results.
+func securityEvent(event string, args ...interface{}) {
+	securityLogger.Info(event, args...)
+}
+
+// rotatingFile is an io.Writer that renames path to path.1 (and path.1 to
+// path.2 and so on, up to keep files) once it grows past maxSize bytes.
+type rotatingFile struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, keep int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	for i := r.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.keep > 0 {
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// sessionHash identifies a session in logs without revealing its key.
+func sessionHash(req *http.Request) string {
+	cookie, _ := req.Cookie(sessionName)
+	if cookie == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(cookie.Value))
+	return hex.EncodeToString(sum[:6])
+}
+
+// clientIP is the address of the client, normalized by normalizeIP. It is
+// RemoteAddr without its port unless the peer is a trusted proxy; then
+// X-Forwarded-For is read from the right, skipping trusted proxies, since
+// only the entries they appended can be believed.
+func clientIP(req *http.Request) string {
+	ip := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	ip = normalizeIP(ip)
+	if !trustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := normalizeIP(strings.TrimSpace(hops[i]))
+		if hop == "" {
+			break
+		}
+		ip = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func accessLog(h http.Handler) http.Handler {
+	if accessLogger == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, req)
+		if sw.status == 0 {
+			sw.status = 200
+		}
+		accessLogger.Info("access",
+			"method", req.Method,
+			"path", req.URL.Path,
+			"status", sw.status,
+			"bytes", sw.bytes,
+			"duration", time.Since(start),
+			"ip", clientIP(req),
+			"session", sessionHash(req),
+		)
+	})
+}
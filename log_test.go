@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type syncBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+// captureSecurityEvents returns the security events logged while f runs,
+// one logfmt line each.
+func captureSecurityEvents(f func()) string {
+	var buf syncBuffer
+	saved := securityLogger
+	securityLogger = slog.New(slog.NewTextHandler(&buf, nil))
+	defer func() { securityLogger = saved }()
+	f()
+	buf.Lock()
+	defer buf.Unlock()
+	return buf.String()
+}
+
+func TestUnlockEvent(t *testing.T) {
+	withLoginEnv([]*User{{ID: 1, Login: "alice", password: "pw"}}, func() {
+		events := captureSecurityEvents(func() {
+			attemptLogin(loginRequest("alice", "x", "192.0.2.1"))
+			attemptLogin(loginRequest("alice", "x", "192.0.2.1"))
+			attemptLogin(loginRequest("alice", "pw", "192.0.2.1"))
+			attemptLogin(loginRequest("alice", "pw", "192.0.2.1"))
+		})
+		if n := strings.Count(events, "msg=user_unlocked"); n != 1 || !strings.Contains(events, "failures=2") {
+			t.Errorf("want one unlock clearing 2 failures:\n%s", events)
+		}
+	})
+}
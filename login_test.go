@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func loginRequest(login, password, ip string) *http.Request {
+	form := url.Values{"login": {login}, "password": {password}}
+	req := httptest.NewRequest("POST", "/login", nil)
+	req.PostForm = form
+	req.RemoteAddr = ip
+	return req
+}
+
+// withLoginEnv runs f against a fresh history holding the given users, with
+// queued login_log rows discarded instead of written.
+func withLoginEnv(users []*User, f func()) {
+	savedRepo, savedCh := userRepository, insertCh
+	userRepository = NewUserRepository()
+	for _, u := range users {
+		userRepository.Add(u)
+	}
+	insertCh = make(chan *UserLogin, 100)
+	done := make(chan struct{})
+	go func() {
+		for l := range insertCh {
+			inserts.written(l, 0)
+		}
+		close(done)
+	}()
+	defer func() {
+		close(insertCh)
+		<-done
+		userRepository, insertCh = savedRepo, savedCh
+	}()
+	withHistory(NewLoginHistory(), 3, 10, f)
+}
+
+// concurrentLogins runs n attempts at once and counts the results.
+func concurrentLogins(n int, req func(i int) *http.Request) map[error]int {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[error]int)
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := req(i)
+			<-start
+			_, err := attemptLogin(r)
+			mu.Lock()
+			results[err]++
+			mu.Unlock()
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	return results
+}
+
+func TestConcurrentWrongPasswordsLockAtThreshold(t *testing.T) {
+	users := []*User{{ID: 1, Login: "alice", password: "secret"}}
+	withLoginEnv(users, func() {
+		results := concurrentLogins(200, func(i int) *http.Request {
+			// Distinct addresses so the IP ban never triggers.
+			return loginRequest("alice", "wrong", fmt.Sprintf("10.0.%d.%d", i/100, i%100))
+		})
+		if results[ErrWrongPassword] != UserLockThreshold {
+			t.Errorf("%d password checks, want %d (results %v)", results[ErrWrongPassword], UserLockThreshold, results)
+		}
+		if results[ErrLockedUser] != 200-UserLockThreshold {
+			t.Errorf("%d locked, want %d", results[ErrLockedUser], 200-UserLockThreshold)
+		}
+		if _, err := attemptLogin(loginRequest("alice", "secret", "10.1.0.1")); err != ErrLockedUser {
+			t.Errorf("correct password after lock: %v", err)
+		}
+	})
+}
+
+func TestConcurrentFailuresBanAtThreshold(t *testing.T) {
+	withLoginEnv(nil, func() {
+		results := concurrentLogins(200, func(i int) *http.Request {
+			return loginRequest(fmt.Sprintf("user%d", i), "x", "192.0.2.1")
+		})
+		if results[ErrUserNotFound] != IPBanThreshold {
+			t.Errorf("%d attempts evaluated, want %d (results %v)", results[ErrUserNotFound], IPBanThreshold, results)
+		}
+		if results[ErrBannedIP] != 200-IPBanThreshold {
+			t.Errorf("%d banned, want %d", results[ErrBannedIP], 200-IPBanThreshold)
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are exposed on /metrics in the Prometheus text format. The
+// exposition is written by hand to avoid pulling in the client library.
+
+var loginResultNames = []string{"success", "banned_ip", "locked_user", "user_not_found", "wrong_password", "wrong_otp", "mfa_required", "other"}
+
+var loginResults = make([]int64, len(loginResultNames))
+
+// loginResult maps an attemptLogin error to its index in loginResultNames.
+func loginResult(err error) int {
+	i := 0
+	switch err {
+	case nil:
+	case ErrBannedIP:
+		i = 1
+	case ErrLockedUser:
+		i = 2
+	case ErrUserNotFound:
+		i = 3
+	case ErrWrongPassword:
+		i = 4
+	case ErrWrongOTP:
+		i = 5
+	case ErrMFARequired:
+		i = 6
+	default:
+		i = 7
+	}
+	return i
+}
+
+func observeLogin(err error) {
+	atomic.AddInt64(&loginResults[loginResult(err)], 1)
+}
+
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+type histogram struct {
+	sync.Mutex
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	h.Lock()
+	if i < len(latencyBuckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+	h.Unlock()
+}
+
+var (
+	routeLatencyMu sync.Mutex
+	routeLatency   = make(map[string]*histogram)
+)
+
+// instrument records the latency of h under the given route label.
+func instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	routeLatencyMu.Lock()
+	hist := routeLatency[route]
+	if hist == nil {
+		hist = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		routeLatency[route] = hist
+	}
+	routeLatencyMu.Unlock()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h(w, r)
+		hist.observe(time.Since(start).Seconds())
+	}
+}
+
+func writeMetric(buf *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeMetrics(buf *bytes.Buffer) {
+	writeMetric(buf, "isu4_login_attempts_total", "counter", "Login attempts by result.")
+	for i, name := range loginResultNames {
+		fmt.Fprintf(buf, "isu4_login_attempts_total{result=%q} %d\n", name, atomic.LoadInt64(&loginResults[i]))
+	}
+
+	if loginTarpit != nil {
+		writeMetric(buf, "isu4_tarpit_waiting", "gauge", "Failed logins being held by the tarpit.")
+		fmt.Fprintf(buf, "isu4_tarpit_waiting %d\n", len(loginTarpit.slots))
+		writeMetric(buf, "isu4_tarpit_rejected_total", "counter", "Failed logins rejected because the tarpit was full.")
+		fmt.Fprintf(buf, "isu4_tarpit_rejected_total %d\n", atomic.LoadInt64(&loginTarpit.rejected))
+	}
+
+	writeMetric(buf, "isu4_sessions", "gauge", "Sessions held in memory.")
+	fmt.Fprintf(buf, "isu4_sessions %d\n", sessionStore.Len())
+
+	writeMetric(buf, "isu4_insert_queue_length", "gauge", "login_log rows waiting to be inserted.")
+	fmt.Fprintf(buf, "isu4_insert_queue_length %d\n", len(insertCh))
+	writeMetric(buf, "isu4_insert_queue_capacity", "gauge", "Capacity of the login_log insert queue.")
+	fmt.Fprintf(buf, "isu4_insert_queue_capacity %d\n", cap(insertCh))
+
+	names, addrs, prefixes, entries := loginHistory.Size()
+	writeMetric(buf, "isu4_login_history_entries", "gauge", "Login attempts applied to LoginHistory.")
+	fmt.Fprintf(buf, "isu4_login_history_entries %d\n", entries)
+	writeMetric(buf, "isu4_login_history_keys", "gauge", "Distinct keys in LoginHistory.")
+	fmt.Fprintf(buf, "isu4_login_history_keys{index=\"name\"} %d\n", names)
+	fmt.Fprintf(buf, "isu4_login_history_keys{index=\"addr\"} %d\n", addrs)
+	fmt.Fprintf(buf, "isu4_login_history_keys{index=\"prefix\"} %d\n", prefixes)
+
+	writeMetric(buf, "isu4_banned_ips", "gauge", "IP addresses currently banned.")
+	fmt.Fprintf(buf, "isu4_banned_ips %d\n", len(memBannedIPs()))
+	writeMetric(buf, "isu4_banned_prefixes", "gauge", "Networks currently banned.")
+	fmt.Fprintf(buf, "isu4_banned_prefixes %d\n", len(memBannedPrefixes()))
+	writeMetric(buf, "isu4_locked_users", "gauge", "Users currently locked.")
+	fmt.Fprintf(buf, "isu4_locked_users %d\n", len(memLockedUsers()))
+	writeMetric(buf, "isu4_stuffing_banned_ips", "gauge", "IP addresses currently banned for credential stuffing or password spraying.")
+	fmt.Fprintf(buf, "isu4_stuffing_banned_ips %d\n", len(stuffing.flaggedIPs(clock.Now())))
+
+	routeLatencyMu.Lock()
+	routes := make([]string, 0, len(routeLatency))
+	for route := range routeLatency {
+		routes = append(routes, route)
+	}
+	routeLatencyMu.Unlock()
+	sort.Strings(routes)
+
+	writeMetric(buf, "isu4_http_request_duration_seconds", "histogram", "Request latency by route.")
+	for _, route := range routes {
+		routeLatencyMu.Lock()
+		h := routeLatency[route]
+		routeLatencyMu.Unlock()
+
+		h.Lock()
+		var cum uint64
+		for i, le := range latencyBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(buf, "isu4_http_request_duration_seconds_bucket{route=%q,le=%q} %d\n", route, formatFloat(le), cum)
+		}
+		fmt.Fprintf(buf, "isu4_http_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, h.count)
+		fmt.Fprintf(buf, "isu4_http_request_duration_seconds_sum{route=%q} %s\n", route, formatFloat(h.sum))
+		fmt.Fprintf(buf, "isu4_http_request_duration_seconds_count{route=%q} %d\n", route, h.count)
+		h.Unlock()
+	}
+}
+
+func metrics(w http.ResponseWriter, r *http.Request) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	writeMetrics(buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+	buf.Reset()
+	bufferPool.Put(buf)
+}
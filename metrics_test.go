@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var (
+	metricCommentRe = regexp.MustCompile(`^# (HELP|TYPE) ([a-zA-Z_:][a-zA-Z0-9_:]*) (.+)$`)
+	metricSampleRe  = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{(?:[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\[\\"n])*",?)*\})? (\S+)$`)
+	metricLabelRe   = regexp.MustCompile(`([a-zA-Z_][a-zA-Z0-9_]*)="((?:[^"\\\n]|\\[\\"n])*)"`)
+)
+
+type metricSample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// parseMetrics checks body against the Prometheus text format and returns
+// its samples. Every sample must follow the HELP and TYPE of its family.
+func parseMetrics(t *testing.T, body string) []metricSample {
+	t.Helper()
+	types := make(map[string]string)
+	helped := make(map[string]bool)
+	var samples []metricSample
+	sc := bufio.NewScanner(strings.NewReader(body))
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := sc.Text()
+		if m := metricCommentRe.FindStringSubmatch(line); m != nil {
+			if m[1] == "HELP" {
+				helped[m[2]] = true
+				continue
+			}
+			switch m[3] {
+			case "counter", "gauge", "histogram", "summary", "untyped":
+			default:
+				t.Errorf("line %d: unknown type %q", lineno, m[3])
+			}
+			if types[m[2]] != "" {
+				t.Errorf("line %d: %s typed twice", lineno, m[2])
+			}
+			types[m[2]] = m[3]
+			continue
+		}
+		m := metricSampleRe.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("line %d: bad sample %q", lineno, line)
+			continue
+		}
+		family := m[1]
+		if types[family] == "" {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				if f := strings.TrimSuffix(m[1], suffix); f != m[1] && types[f] == "histogram" {
+					family = f
+				}
+			}
+		}
+		if types[family] == "" || !helped[family] {
+			t.Errorf("line %d: %s has no HELP or TYPE before it", lineno, m[1])
+		}
+		v, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Errorf("line %d: value: %v", lineno, err)
+		}
+		s := metricSample{name: m[1], labels: make(map[string]string), value: v}
+		for _, l := range metricLabelRe.FindAllStringSubmatch(m[2], -1) {
+			s.labels[l[1]] = l[2]
+		}
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+func TestMetricsExposition(t *testing.T) {
+	withLoginEnv([]*User{{ID: 1, Login: "alice", password: "pw"}}, func() {
+		attemptLogin(loginRequest("alice", "x", "192.0.2.1"))
+		// A fresh histogram, so the counts below hold on every run.
+		dropRoute := func() {
+			routeLatencyMu.Lock()
+			delete(routeLatency, "metrics_test")
+			routeLatencyMu.Unlock()
+		}
+		dropRoute()
+		defer dropRoute()
+		route := instrument("metrics_test", func(w http.ResponseWriter, r *http.Request) {})
+		route(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+		w := serve(newAdminMux(), "GET", "/metrics")
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+			t.Errorf("Content-Type %q", ct)
+		}
+		samples := parseMetrics(t, w.Body.String())
+
+		get := func(name string, labels ...string) (float64, bool) {
+			for _, s := range samples {
+				if s.name != name {
+					continue
+				}
+				match := true
+				for i := 0; i+1 < len(labels); i += 2 {
+					match = match && s.labels[labels[i]] == labels[i+1]
+				}
+				if match {
+					return s.value, true
+				}
+			}
+			return 0, false
+		}
+		for _, name := range loginResultNames {
+			if _, ok := get("isu4_login_attempts_total", "result", name); !ok {
+				t.Errorf("no login result %s", name)
+			}
+		}
+		if v, _ := get("isu4_login_history_entries"); v != 1 {
+			t.Errorf("history entries %v, want 1", v)
+		}
+		if v, _ := get("isu4_login_history_keys", "index", "name"); v != 1 {
+			t.Errorf("history names %v, want 1", v)
+		}
+
+		// Buckets are cumulative and end at +Inf, which equals the count.
+		last := -1.0
+		for _, s := range samples {
+			if s.name != "isu4_http_request_duration_seconds_bucket" || s.labels["route"] != "metrics_test" {
+				continue
+			}
+			if s.value < last {
+				t.Errorf("bucket le=%s decreases", s.labels["le"])
+			}
+			last = s.value
+		}
+		inf, ok := get("isu4_http_request_duration_seconds_bucket", "route", "metrics_test", "le", "+Inf")
+		count, _ := get("isu4_http_request_duration_seconds_count", "route", "metrics_test")
+		if !ok || inf != 1 || count != 1 {
+			t.Errorf("+Inf bucket %v, count %v, want 1", inf, count)
+		}
+	})
+}
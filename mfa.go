@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With ISU4_MFA=1 users may enroll a TOTP (RFC 6238) authenticator from
+// /mfa/setup. A correct password for an enrolled user only gets a pending
+// session and is not recorded; /mfa asks for the one-time code, or one of
+// the recovery codes handed out at enrollment, and records the login. A
+// wrong code is a failed login, so it counts toward locking the user and
+// banning the address.
+//
+// Enrollments are kept in ISU4_MFA_FILE (default mfa.tsv), one
+// "login<TAB>base32 secret<TAB>comma-separated recovery code hashes<TAB>
+// last used time step" per line.
+
+const (
+	totpStep       = 30 // seconds
+	totpDigits     = 6
+	totpSkew       = 1 // steps accepted either side of now
+	totpIssuer     = "isucon4"
+	recoveryCodeN  = 10
+	mfaPendingTime = 5 * time.Minute
+)
+
+var ErrWrongOTP = errors.New("Wrong one-time code")
+
+var (
+	mfa *mfaStore // nil when MFA is off
+	b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// hotp is RFC 4226's HOTP value of secret at counter.
+func hotp(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	m := hmac.New(sha1.New, secret)
+	m.Write(msg[:])
+	sum := m.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", v%1000000) // totpDigits
+}
+
+func totpCounter(t time.Time) uint64 {
+	return uint64(t.Unix()) / totpStep
+}
+
+// matchTOTP returns the counter code is valid at, within totpSkew steps of
+// now.
+func matchTOTP(secret []byte, code string, now time.Time) (uint64, bool) {
+	c := totpCounter(now)
+	for d := -totpSkew; d <= totpSkew; d++ {
+		n := uint64(int64(c) + int64(d))
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, n)), []byte(code)) == 1 {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+func newTOTPSecret() []byte {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	must(err)
+	return b
+}
+
+// provisioningURI is the otpauth:// URI authenticator apps read from a QR
+// code.
+func provisioningURI(login string, secret []byte) string {
+	v := url.Values{}
+	v.Set("secret", b32.EncodeToString(secret))
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpStep))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+login) + "?" + v.Encode()
+}
+
+// normalizeRecoveryCode drops the separators people type or leave out.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func newRecoveryCode() string {
+	b := make([]byte, 5)
+	_, err := rand.Read(b)
+	must(err)
+	s := strings.ToLower(b32.EncodeToString(b))
+	return s[:4] + "-" + s[4:]
+}
+
+type mfaEnrollment struct {
+	secret   []byte
+	recovery []string // hashes of the unused recovery codes
+	lastUsed uint64   // counter of the last accepted code, so it cannot be replayed
+}
+
+type mfaStore struct {
+	sync.Mutex
+	path  string
+	users map[string]*mfaEnrollment
+}
+
+func loadMFAStore(path string) (*mfaStore, error) {
+	s := &mfaStore{path: path, users: make(map[string]*mfaEnrollment)}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	lineno := 0
+	for sc.Scan() {
+		lineno++
+		line := sc.Text()
+		if line == "" {
+			continue
+		}
+		f := strings.Split(line, "\t")
+		if len(f) != 3 && len(f) != 4 {
+			return nil, fmt.Errorf("%s:%d: want 4 fields", path, lineno)
+		}
+		secret, err := b32.DecodeString(f[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+		e := &mfaEnrollment{secret: secret}
+		if f[2] != "" {
+			e.recovery = strings.Split(f[2], ",")
+		}
+		// Files written before the last step was kept have three fields.
+		if len(f) == 4 {
+			if e.lastUsed, err = strconv.ParseUint(f[3], 10, 64); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+			}
+		}
+		s.users[f[0]] = e
+	}
+	return s, nil
+}
+
+// save writes every enrollment to s.path. s must be locked.
+func (s *mfaStore) save() error {
+	logins := make([]string, 0, len(s.users))
+	for login := range s.users {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+	var buf bytes.Buffer
+	for _, login := range logins {
+		e := s.users[login]
+		fmt.Fprintf(&buf, "%s\t%s\t%s\t%d\n", login, b32.EncodeToString(e.secret), strings.Join(e.recovery, ","), e.lastUsed)
+	}
+	return writeFileAtomic(s.path, buf.Bytes())
+}
+
+func (s *mfaStore) enrolled(login string) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.users[login] != nil
+}
+
+// enroll stores secret for login and returns a fresh set of recovery codes.
+// used is the time step of the code that confirmed the secret, which may
+// not be used again.
+func (s *mfaStore) enroll(login string, secret []byte, used uint64) ([]string, error) {
+	codes := make([]string, recoveryCodeN)
+	hashes := make([]string, recoveryCodeN)
+	for i := range codes {
+		codes[i] = newRecoveryCode()
+		hashes[i] = calcPassHash(normalizeRecoveryCode(codes[i]), login)
+	}
+	s.Lock()
+	defer s.Unlock()
+	saved := s.users[login]
+	s.users[login] = &mfaEnrollment{secret: secret, recovery: hashes, lastUsed: used}
+	if err := s.save(); err != nil {
+		s.users[login] = saved
+		if saved == nil {
+			delete(s.users, login)
+		}
+		return nil, err
+	}
+	return codes, nil
+}
+
+// verify reports whether code is login's current one-time code or one of
+// its unused recovery codes, which it then uses up. It only touches memory,
+// so it can run under the login history locks; persist writes the change.
+func (s *mfaStore) verify(login, code string, now time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+	e := s.users[login]
+	if e == nil {
+		return false
+	}
+	if n, ok := matchTOTP(e.secret, strings.TrimSpace(code), now); ok {
+		if n <= e.lastUsed {
+			return false
+		}
+		e.lastUsed = n
+		return true
+	}
+	h := calcPassHash(normalizeRecoveryCode(code), login)
+	for i, r := range e.recovery {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(r)) == 1 {
+			e.recovery = append(e.recovery[:i:i], e.recovery[i+1:]...)
+			securityEvent("recovery_code_used", "login", login, "left", len(e.recovery))
+			return true
+		}
+	}
+	return false
+}
+
+// persist saves the codes verify used up. A failure is only logged: the
+// login is already recorded, and the codes stay used up until a restart.
+func (s *mfaStore) persist() {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.save(); err != nil {
+		logger.Error("save MFA enrollments", "err", err)
+	}
+}
+
+func initMFA() {
+	if getEnv("ISU4_MFA", "") != "1" {
+		return
+	}
+	var err error
+	mfa, err = loadMFAStore(getEnv("ISU4_MFA_FILE", "mfa.tsv"))
+	must(err)
+}
+
+// attemptMFA checks the second step of user's login and records the
+// attempt, as the password step did not. Bans and locks apply as they do
+// to /login, and a wrong code counts as a failed login. The used-up code is
+// saved after the attempt, outside the login history locks.
+func attemptMFA(req *http.Request, user *User) error {
+	loginGate.RLock()
+	defer loginGate.RUnlock()
+
+	ip := clientIP(req)
+	ul := &UserLogin{Id: user.ID, Ip: ip, Login: user.Login, CreatedAt: clock.Now()}
+	refuse := refuseAttempt(user, ip, ul.CreatedAt)
+	st, err := loginHistory.Attempt(ul, func(st attemptStates) error {
+		if err := refuse(st); err != nil {
+			return err
+		}
+		if !mfa.verify(user.Login, req.PostFormValue("code"), ul.CreatedAt) {
+			return ErrWrongOTP
+		}
+		return nil
+	})
+	createLoginLog(ul, user, st)
+	if err == nil {
+		mfa.persist()
+	}
+	return err
+}
+
+// pendingUser returns the user whose password sess was given for, if the
+// second step has not timed out.
+func pendingUser(sess *Session) *User {
+	if sess.MFAUserId == 0 || !clock.Now().Before(sess.mfaExpires) {
+		return nil
+	}
+	return userRepository.ById(sess.MFAUserId)
+}
+
+type mfaPage struct {
+	Notice    string
+	CSRFToken string
+}
+
+type mfaSetupPage struct {
+	Notice    string
+	URI       string // empty when already enrolled
+	Secret    string
+	CSRFToken string
+}
+
+type mfaRecoveryPage struct {
+	Codes []string
+}
+
+func mfa_get(w http.ResponseWriter, req *http.Request) {
+	sess := sessionStore.Get(req)
+	if pendingUser(sess) == nil {
+		sess.Notice = "You must be logged in"
+		sessionStore.Set(w, sess)
+		http.Redirect(w, req, "/", 302)
+		return
+	}
+	notice := sess.Notice
+	if notice != "" {
+		sess.Notice = ""
+		sessionStore.Set(w, sess)
+	}
+	render(w, "mfa", mfaPage{Notice: notice, CSRFToken: csrfToken(w, req)})
+}
+
+func mfa_post(w http.ResponseWriter, req *http.Request) {
+	sess := sessionStore.Get(req)
+	user := pendingUser(sess)
+	if user == nil {
+		sess.MFAUserId = 0
+		sess.Notice = "You must be logged in"
+		sessionStore.Set(w, sess)
+		http.Redirect(w, req, "/", 302)
+		return
+	}
+	err := attemptMFA(req, user)
+	observeLogin(err)
+	securityEvent("login_mfa", "login", user.Login, "ip", clientIP(req), "result", loginResultNames[loginResult(err)])
+	switch err {
+	case nil:
+		sess.MFAUserId = 0
+		sess.UserId = user.ID
+		sessionStore.Set(w, sess)
+		http.Redirect(w, req, "/mypage", 302)
+	case ErrBannedIP:
+		sess.MFAUserId = 0
+		sess.Notice = "You're banned."
+		sessionStore.Set(w, sess)
+		http.Redirect(w, req, "/", 302)
+	case ErrLockedUser:
+		sess.MFAUserId = 0
+		sess.Notice = "This account is locked."
+		sessionStore.Set(w, sess)
+		http.Redirect(w, req, "/", 302)
+	default:
+		sess.Notice = "Wrong one-time code"
+		sessionStore.Set(w, sess)
+		http.Redirect(w, req, "/mfa", 302)
+	}
+}
+
+func mfa_setup_get(w http.ResponseWriter, req *http.Request) {
+	sess := sessionStore.Get(req)
+	user := loggedInUser(w, req, sess)
+	if user == nil {
+		return
+	}
+	data := mfaSetupPage{Notice: sess.Notice, CSRFToken: csrfToken(w, req)}
+	sess.Notice = ""
+	if mfa.enrolled(user.Login) {
+		data.Notice = "二段階認証は設定済みです"
+	} else {
+		// The secret stays in the session until a code from it is entered,
+		// so reloading the page keeps what was already scanned.
+		if sess.MFASecret == "" {
+			sess.MFASecret = b32.EncodeToString(newTOTPSecret())
+		}
+		secret, _ := b32.DecodeString(sess.MFASecret)
+		data.URI, data.Secret = provisioningURI(user.Login, secret), sess.MFASecret
+	}
+	sessionStore.Set(w, sess)
+	render(w, "mfa_setup", data)
+}
+
+func mfa_setup_post(w http.ResponseWriter, req *http.Request) {
+	sess := sessionStore.Get(req)
+	user := loggedInUser(w, req, sess)
+	if user == nil {
+		return
+	}
+	secret, err := b32.DecodeString(sess.MFASecret)
+	if sess.MFASecret == "" || err != nil || mfa.enrolled(user.Login) {
+		http.Redirect(w, req, "/mfa/setup", 302)
+		return
+	}
+	used, ok := matchTOTP(secret, strings.TrimSpace(req.PostFormValue("code")), clock.Now())
+	if !ok {
+		sess.Notice = "Wrong one-time code"
+		sessionStore.Set(w, sess)
+		http.Redirect(w, req, "/mfa/setup", 302)
+		return
+	}
+	codes, err := mfa.enroll(user.Login, secret, used)
+	if err != nil {
+		logger.Error("save MFA enrollments", "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	sess.MFASecret = ""
+	sessionStore.Set(w, sess)
+	securityEvent("mfa_enrolled", "login", user.Login, "ip", clientIP(req))
+	render(w, "mfa_recovery", mfaRecoveryPage{Codes: codes})
+}
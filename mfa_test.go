@@ -0,0 +1,301 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226 appendix D.
+	secret := []byte("12345678901234567890")
+	for i, want := range []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"} {
+		if got := hotp(secret, uint64(i)); got != want {
+			t.Errorf("hotp(%d) = %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B, SHA1, cut to six digits.
+	secret := []byte("12345678901234567890")
+	for _, c := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	} {
+		now := time.Unix(c.unix, 0)
+		if got := hotp(secret, totpCounter(now)); got != c.want {
+			t.Errorf("%d: %s, want %s", c.unix, got, c.want)
+		}
+		if _, ok := matchTOTP(secret, c.want, now.Add(totpStep*time.Second)); !ok {
+			t.Errorf("%d: code not accepted a step later", c.unix)
+		}
+		if _, ok := matchTOTP(secret, c.want, now.Add(2*totpStep*time.Second)); ok {
+			t.Errorf("%d: code accepted two steps later", c.unix)
+		}
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	u, err := url.Parse(provisioningURI("alice", []byte("12345678901234567890")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/isucon4:alice" ||
+		q.Get("secret") != "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" || q.Get("issuer") != "isucon4" ||
+		q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("bad URI %s", u)
+	}
+}
+
+// withMFA turns MFA on with an empty store in a temporary file.
+func withMFA(t *testing.T, f func()) {
+	s, err := loadMFAStore(filepath.Join(t.TempDir(), "mfa.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := mfa
+	mfa = s
+	defer func() { mfa = saved }()
+	f()
+}
+
+func TestMFAStore(t *testing.T) {
+	now := time.Unix(1400000000, 0)
+	secret := newTOTPSecret()
+	withMFA(t, func() {
+		codes, err := mfa.enroll("alice", secret, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(codes) != recoveryCodeN {
+			t.Fatalf("%d recovery codes", len(codes))
+		}
+		code := hotp(secret, totpCounter(now))
+		if !mfa.verify("alice", code, now) {
+			t.Error("current code rejected")
+		}
+		if mfa.verify("alice", code, now) {
+			t.Error("code accepted twice")
+		}
+		if mfa.verify("bob", code, now) || mfa.verify("alice", "000000", now) {
+			t.Error("wrong code accepted")
+		}
+		if !mfa.verify("alice", strings.ToUpper(strings.Replace(codes[3], "-", " ", 1)), now) {
+			t.Error("recovery code rejected")
+		}
+		if mfa.verify("alice", codes[3], now) {
+			t.Error("recovery code accepted twice")
+		}
+
+		// Enrollments and used-up recovery codes survive a restart.
+		mfa.persist()
+		s, err := loadMFAStore(mfa.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !s.enrolled("alice") || s.enrolled("bob") {
+			t.Fatal("enrollments not reloaded")
+		}
+		if s.verify("alice", codes[3], now) || !s.verify("alice", codes[4], now) {
+			t.Error("recovery codes not reloaded")
+		}
+		if s.verify("alice", code, now) {
+			t.Error("code accepted again after a restart")
+		}
+		if !s.verify("alice", hotp(secret, totpCounter(now)+1), now) {
+			t.Error("secret not reloaded")
+		}
+	})
+}
+
+// postForm posts form to path on mux with cookie and returns the response.
+func postForm(mux http.Handler, path string, cookie *http.Cookie, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "192.0.2.1:1234"
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func getWithCookie(mux http.Handler, path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func TestMFALogin(t *testing.T) {
+	loadTestTemplates(t)
+	fc := newFakeClock(time.Unix(1400000000, 0))
+	secret := newTOTPSecret()
+	withClock(fc, func() {
+		withMFA(t, func() {
+			withLoginEnv([]*User{{ID: 1, Login: "alice", password: "pw"}}, func() {
+				mux := newPublicMux()
+				if _, err := mfa.enroll("alice", secret, 0); err != nil {
+					t.Fatal(err)
+				}
+				login := func() *http.Cookie {
+					w := postLogin(mux, nil, url.Values{"login": {"alice"}, "password": {"pw"}})
+					if w.Code != 302 || w.Header().Get("Location") != "/mfa" {
+						t.Fatalf("login: %d %s", w.Code, w.Header().Get("Location"))
+					}
+					return w.Result().Cookies()[0]
+				}
+				location := func(w *httptest.ResponseRecorder) string {
+					t.Helper()
+					if w.Code != 302 {
+						t.Fatalf("%d, want a redirect", w.Code)
+					}
+					return w.Header().Get("Location")
+				}
+
+				cookie := login()
+				if l := location(getWithCookie(mux, "/mypage", cookie)); l != "/" {
+					t.Fatalf("pending session reached /mypage: %s", l)
+				}
+				if _, _, _, n := loginHistory.Size(); n != 0 {
+					t.Fatalf("password step recorded %d attempts", n)
+				}
+				cookie = login()
+				if w := getWithCookie(mux, "/mfa", cookie); w.Code != 200 || !strings.Contains(w.Body.String(), `name="code"`) {
+					t.Fatalf("second step page: %d\n%s", w.Code, w.Body)
+				}
+				if l := location(postForm(mux, "/mfa", cookie, url.Values{"code": {hotp(secret, totpCounter(fc.Now()))}})); l != "/mypage" {
+					t.Fatalf("right code: %s", l)
+				}
+				if w := getWithCookie(mux, "/mypage", cookie); w.Code != 200 {
+					t.Fatalf("mypage after the second step: %d", w.Code)
+				}
+
+				// The second step times out.
+				cookie = login()
+				fc.Advance(mfaPendingTime)
+				if l := location(postForm(mux, "/mfa", cookie, url.Values{"code": {hotp(secret, totpCounter(fc.Now()))}})); l != "/" {
+					t.Fatalf("expired second step: %s", l)
+				}
+
+				// Wrong codes count toward the lock, and giving the password
+				// again does not clear them.
+				for i := 0; i < UserLockThreshold; i++ {
+					cookie = login()
+					if l := location(postForm(mux, "/mfa", cookie, url.Values{"code": {"000000"}})); l != "/mfa" {
+						t.Fatalf("wrong code %d: %s", i, l)
+					}
+				}
+				if locked, _ := isLockedUser(userRepository.ByName("alice")); !locked {
+					t.Fatal("not locked after wrong codes")
+				}
+				fc.Advance(totpStep * time.Second)
+				if l := location(postForm(mux, "/mfa", cookie, url.Values{"code": {hotp(secret, totpCounter(fc.Now()))}})); l != "/" {
+					t.Fatalf("locked user passed the second step: %s", l)
+				}
+			})
+		})
+	})
+}
+
+func TestMFABannedIP(t *testing.T) {
+	loadTestTemplates(t)
+	fc := newFakeClock(time.Unix(1400000000, 0))
+	secret := newTOTPSecret()
+	withClock(fc, func() {
+		withMFA(t, func() {
+			withLoginEnv([]*User{{ID: 1, Login: "alice", password: "pw"}}, func() {
+				mux := newPublicMux()
+				if _, err := mfa.enroll("alice", secret, 0); err != nil {
+					t.Fatal(err)
+				}
+				cookie := postLogin(mux, nil, url.Values{"login": {"alice"}, "password": {"pw"}}).Result().Cookies()[0]
+				// The address is banned between the two steps.
+				for i := 0; i < IPBanThreshold; i++ {
+					attemptLogin(loginRequest("nobody", "x", "192.0.2.1"))
+				}
+				w := postForm(mux, "/mfa", cookie, url.Values{"code": {hotp(secret, totpCounter(fc.Now()))}})
+				if l := w.Header().Get("Location"); l != "/" {
+					t.Errorf("banned address passed the second step: %s", l)
+				}
+			})
+		})
+	})
+}
+
+var mfaSecretRe = regexp.MustCompile(`id="mfa-secret">([A-Z2-7]+)<`)
+
+func TestMFAEnrollment(t *testing.T) {
+	loadTestTemplates(t)
+	fc := newFakeClock(time.Unix(1400000000, 0))
+	withClock(fc, func() {
+		withMFA(t, func() {
+			withLoginEnv([]*User{{ID: 1, Login: "alice", password: "pw"}}, func() {
+				mux := newPublicMux()
+				w := postLogin(mux, nil, url.Values{"login": {"alice"}, "password": {"pw"}})
+				cookie := w.Result().Cookies()[0]
+				if w := getWithCookie(mux, "/mypage", cookie); !strings.Contains(w.Body.String(), "二段階認証（未設定）") {
+					t.Errorf("mypage does not offer MFA:\n%s", w.Body)
+				}
+
+				w = getWithCookie(mux, "/mfa/setup", cookie)
+				m := mfaSecretRe.FindStringSubmatch(w.Body.String())
+				if m == nil || !strings.Contains(w.Body.String(), "otpauth://totp/isucon4:alice?") {
+					t.Fatalf("no secret on the setup page:\n%s", w.Body)
+				}
+				if again := mfaSecretRe.FindStringSubmatch(getWithCookie(mux, "/mfa/setup", cookie).Body.String()); again == nil || again[1] != m[1] {
+					t.Error("reloading the setup page changed the secret")
+				}
+				secret, err := b32.DecodeString(m[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if w := postForm(mux, "/mfa/setup", cookie, url.Values{"code": {"000000"}}); w.Code != 302 || mfa.enrolled("alice") {
+					t.Fatalf("wrong code enrolled: %d", w.Code)
+				}
+				w = postForm(mux, "/mfa/setup", cookie, url.Values{"code": {hotp(secret, totpCounter(fc.Now()))}})
+				if w.Code != 200 || strings.Count(w.Body.String(), "<li><code>") != recoveryCodeN {
+					t.Fatalf("enrollment: %d\n%s", w.Code, w.Body)
+				}
+				if !mfa.enrolled("alice") {
+					t.Fatal("not enrolled")
+				}
+				w = postLogin(mux, nil, url.Values{"login": {"alice"}, "password": {"pw"}})
+				if w.Header().Get("Location") != "/mfa" {
+					t.Fatalf("login after enrolling went to %s", w.Header().Get("Location"))
+				}
+				// The code that confirmed the enrollment is used up.
+				w = postForm(mux, "/mfa", w.Result().Cookies()[0], url.Values{"code": {hotp(secret, totpCounter(fc.Now()))}})
+				if l := w.Header().Get("Location"); l != "/mfa" {
+					t.Errorf("enrollment code accepted again: %s", l)
+				}
+			})
+		})
+	})
+}
+
+func TestMFARoutesOff(t *testing.T) {
+	loadTestTemplates(t)
+	mux := newPublicMux()
+	for _, path := range []string{"/mfa", "/mfa/setup"} {
+		if w := serve(mux, "GET", path); w.Code != http.StatusNotFound {
+			t.Errorf("%s: %d with MFA off", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Users change their password at /mypage/password, giving the current one.
+// Forgotten passwords are reset with a single-use link the admin listener
+// issues at POST /password-reset?login=<login>; using it unlocks the user.
+// Changed passwords are saved in ISU4_PASSWORD_FILE (default
+// passwords.tsv), one "login<TAB>scheme<TAB>salt<TAB>hash" per line, and
+// override dummy_users.tsv. The scheme is "pbkdf2-sha256:<iterations>";
+// lines without one are the salted SHA-256 of earlier versions.
+
+const pbkdf2Scheme = "pbkdf2-sha256"
+
+var (
+	passwordFile       = "passwords.tsv"
+	passwordMinLength  = 8
+	passwordMaxLength  = 256
+	passwordIterations = 600000 // for new passwords; saved ones keep theirs
+
+	passwordMu     sync.Mutex           // serializes changes and writes of passwordFile
+	passwordHashes map[string][3]string // login to scheme, salt and hash
+)
+
+func initPasswords() {
+	passwordFile = getEnv("ISU4_PASSWORD_FILE", passwordFile)
+	var err error
+	passwordMinLength, err = strconv.Atoi(getEnv("ISU4_PASSWORD_MIN_LENGTH", strconv.Itoa(passwordMinLength)))
+	must(err)
+	passwordIterations, err = strconv.Atoi(getEnv("ISU4_PASSWORD_ITERATIONS", strconv.Itoa(passwordIterations)))
+	must(err)
+	ttl, err := time.ParseDuration(getEnv("ISU4_RESET_TOKEN_TTL", "1h"))
+	must(err)
+	resetTokens = newResetTokenStore(ttl)
+	must(loadPasswords(passwordFile))
+}
+
+// pbkdf2SHA256 is RFC 8018's PBKDF2 with HMAC-SHA256, one block long.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	t := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range t {
+			t[j] ^= u[j]
+		}
+	}
+	return t
+}
+
+// schemeIterations returns the iterations of a pbkdf2-sha256 scheme.
+func schemeIterations(scheme string) (int, bool) {
+	name, iterations, ok := strings.Cut(scheme, ":")
+	n, err := strconv.Atoi(iterations)
+	return n, ok && name == pbkdf2Scheme && err == nil && n > 0
+}
+
+// hashPassword hashes password with salt under scheme, "" being the salted
+// SHA-256 of files without schemes. It returns "" for an unknown scheme.
+func hashPassword(scheme, password, salt string) string {
+	if scheme == "" {
+		return calcPassHash(password, salt)
+	}
+	n, ok := schemeIterations(scheme)
+	if !ok {
+		return ""
+	}
+	return hex.EncodeToString(pbkdf2SHA256([]byte(password), []byte(salt), n))
+}
+
+// loadPasswords reads path and applies it to the users loaded so far.
+func loadPasswords(path string) error {
+	hashes := make(map[string][3]string)
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	lineno := 0
+	for sc.Scan() {
+		lineno++
+		if sc.Text() == "" {
+			continue
+		}
+		f := strings.Split(sc.Text(), "\t")
+		if len(f) == 3 {
+			// Written before schemes were tagged.
+			f = []string{f[0], "", f[1], f[2]}
+		}
+		if len(f) != 4 {
+			return fmt.Errorf("%s:%d: want 4 fields", path, lineno)
+		}
+		if _, ok := schemeIterations(f[1]); !ok && f[1] != "" {
+			return fmt.Errorf("%s:%d: unknown scheme %q", path, lineno, f[1])
+		}
+		hashes[f[0]] = [3]string{f[1], f[2], f[3]}
+		if u := userRepository.ByName(f[0]); u != nil {
+			u.setPasswordHash(f[1], f[3], f[2])
+		}
+	}
+	passwordMu.Lock()
+	passwordHashes = hashes
+	passwordMu.Unlock()
+	return nil
+}
+
+var (
+	errPasswordMismatch = errors.New("The new passwords do not match")
+	errPasswordLong     = errors.New("The new password is too long")
+	errPasswordLogin    = errors.New("The new password must not contain your login")
+	errPasswordSimple   = errors.New("The new password must mix at least two of letters, digits and symbols")
+	errPasswordSame     = errors.New("The new password must differ from the current one")
+)
+
+// checkPasswordPolicy returns why password may not become user's password,
+// or nil.
+func checkPasswordPolicy(user *User, password string) error {
+	classes := map[string]bool{}
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			classes["letter"] = true
+		case unicode.IsDigit(r):
+			classes["digit"] = true
+		default:
+			classes["symbol"] = true
+		}
+	}
+	switch {
+	case len([]rune(password)) < passwordMinLength:
+		return fmt.Errorf("The new password must be at least %d characters", passwordMinLength)
+	case len(password) > passwordMaxLength:
+		return errPasswordLong
+	case strings.Contains(strings.ToLower(password), strings.ToLower(user.Login)):
+		return errPasswordLogin
+	case len(classes) < 2:
+		return errPasswordSimple
+	case user.checkPassword(password):
+		return errPasswordSame
+	}
+	return nil
+}
+
+// changePassword saves password for user and then makes it current.
+func changePassword(user *User, password string) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	salt := hex.EncodeToString(b)
+	scheme := pbkdf2Scheme + ":" + strconv.Itoa(passwordIterations)
+	hash := hashPassword(scheme, password, salt)
+
+	passwordMu.Lock()
+	defer passwordMu.Unlock()
+	hashes := make(map[string][3]string, len(passwordHashes)+1)
+	for login, h := range passwordHashes {
+		hashes[login] = h
+	}
+	hashes[user.Login] = [3]string{scheme, salt, hash}
+	logins := make([]string, 0, len(hashes))
+	for login := range hashes {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+	var buf bytes.Buffer
+	for _, login := range logins {
+		h := hashes[login]
+		if h[0] == "" {
+			fmt.Fprintf(&buf, "%s\t%s\t%s\n", login, h[1], h[2])
+		} else {
+			fmt.Fprintf(&buf, "%s\t%s\t%s\t%s\n", login, h[0], h[1], h[2])
+		}
+	}
+	if err := writeFileAtomic(passwordFile, buf.Bytes()); err != nil {
+		return err
+	}
+	passwordHashes = hashes
+	user.setPasswordHash(scheme, hash, salt)
+	return nil
+}
+
+// checkCurrentPassword is the password check of a change. Bans and locks
+// apply as they do to /login, and a wrong password counts as a failed
+// login, so a stolen session cannot guess it for long. A right one is not
+// recorded.
+func checkCurrentPassword(req *http.Request, user *User) error {
+	loginGate.RLock()
+	defer loginGate.RUnlock()
+
+	ip := clientIP(req)
+	ul := &UserLogin{Id: user.ID, Ip: ip, Login: user.Login, CreatedAt: clock.Now()}
+	refuse := refuseAttempt(user, ip, ul.CreatedAt)
+	right := user.checkPassword(req.PostFormValue("current_password"))
+	st, err := loginHistory.Attempt(ul, func(st attemptStates) error {
+		if err := refuse(st); err != nil {
+			return err
+		}
+		if !right {
+			return ErrWrongPassword
+		}
+		return errUnrecorded
+	})
+	if err == errUnrecorded {
+		return nil
+	}
+	createLoginLog(ul, user, st)
+	return err
+}
+
+type passwordPage struct {
+	Notice    string
+	Message   string
+	CSRFToken string
+}
+
+type passwordResetPage struct {
+	Notice    string
+	Token     string
+	CSRFToken string
+}
+
+func password_get(w http.ResponseWriter, req *http.Request) {
+	sess := sessionStore.Get(req)
+	if loggedInUser(w, req, sess) == nil {
+		return
+	}
+	notice := sess.Notice
+	if notice != "" {
+		sess.Notice = ""
+		sessionStore.Set(w, sess)
+	}
+	render(w, "password", passwordPage{Notice: notice, CSRFToken: csrfToken(w, req)})
+}
+
+func password_post(w http.ResponseWriter, req *http.Request) {
+	sess := sessionStore.Get(req)
+	user := loggedInUser(w, req, sess)
+	if user == nil {
+		return
+	}
+	fail := func(notice string) {
+		sess.Notice = notice
+		sessionStore.Set(w, sess)
+		http.Redirect(w, req, "/mypage/password", 302)
+	}
+	switch err := checkCurrentPassword(req, user); err {
+	case nil:
+	case ErrBannedIP:
+		sess.UserId = 0
+		sess.Notice = "You're banned."
+		sessionStore.Set(w, sess)
+		http.Redirect(w, req, "/", 302)
+		return
+	case ErrLockedUser:
+		sess.UserId = 0
+		sess.Notice = "This account is locked."
+		sessionStore.Set(w, sess)
+		http.Redirect(w, req, "/", 302)
+		return
+	default:
+		fail("Wrong password")
+		return
+	}
+	password := req.PostFormValue("new_password")
+	if password != req.PostFormValue("new_password_confirm") {
+		fail(errPasswordMismatch.Error())
+		return
+	}
+	if err := checkPasswordPolicy(user, password); err != nil {
+		fail(err.Error())
+		return
+	}
+	if err := changePassword(user, password); err != nil {
+		logger.Error("save password", "login", user.Login, "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	sessionStore.DropUser(user.ID, sess.Key)
+	securityEvent("password_changed", "login", user.Login, "ip", clientIP(req))
+	render(w, "password", passwordPage{Message: "パスワードを変更しました", CSRFToken: csrfToken(w, req)})
+}
+
+// resetTokenStore keeps the SHA-256 of each outstanding reset token, so
+// the tokens themselves exist only in the links handed out.
+type resetTokenStore struct {
+	sync.Mutex
+	ttl    time.Duration
+	tokens map[string]*resetToken // by hash
+}
+
+type resetToken struct {
+	userId  int
+	expires time.Time
+}
+
+var resetTokens = newResetTokenStore(time.Hour)
+
+func newResetTokenStore(ttl time.Duration) *resetTokenStore {
+	return &resetTokenStore{ttl: ttl, tokens: make(map[string]*resetToken)}
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issue returns a new token for user, replacing any earlier one.
+func (s *resetTokenStore) issue(user *User, now time.Time) (string, time.Time) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	must(err)
+	token := hex.EncodeToString(b)
+	s.Lock()
+	defer s.Unlock()
+	for h, t := range s.tokens {
+		if t.userId == user.ID || !now.Before(t.expires) {
+			delete(s.tokens, h)
+		}
+	}
+	t := &resetToken{userId: user.ID, expires: now.Add(s.ttl)}
+	s.tokens[hashResetToken(token)] = t
+	return token, t.expires
+}
+
+// user returns the user token resets, or nil if it is unknown or expired.
+// With consume the token is used up.
+func (s *resetTokenStore) user(token string, now time.Time, consume bool) *User {
+	h := hashResetToken(token)
+	s.Lock()
+	t := s.tokens[h]
+	if t != nil && (consume || !now.Before(t.expires)) {
+		delete(s.tokens, h)
+	}
+	s.Unlock()
+	if t == nil || !now.Before(t.expires) {
+		return nil
+	}
+	return userRepository.ById(t.userId)
+}
+
+// issueResetToken is the admin route handing out reset links.
+func issueResetToken(w http.ResponseWriter, req *http.Request) {
+	user := userRepository.ByName(req.FormValue("login"))
+	if user == nil {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+	token, expires := resetTokens.issue(user, clock.Now())
+	securityEvent("password_reset_issued", "login", user.Login)
+	data, _ := json.Marshal(map[string]string{
+		"login":   user.Login,
+		"url":     "/password/reset?token=" + token,
+		"expires": expires.Format(time.RFC3339),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+const invalidResetNotice = "This reset link is invalid or has expired."
+
+func password_reset_get(w http.ResponseWriter, req *http.Request) {
+	sess := sessionStore.Get(req)
+	token := req.FormValue("token")
+	if resetTokens.user(token, clock.Now(), false) == nil {
+		sess.Notice = invalidResetNotice
+		sessionStore.Set(w, sess)
+		http.Redirect(w, req, "/", 302)
+		return
+	}
+	notice := sess.Notice
+	if notice != "" {
+		sess.Notice = ""
+		sessionStore.Set(w, sess)
+	}
+	render(w, "password_reset", passwordResetPage{Notice: notice, Token: token, CSRFToken: csrfToken(w, req)})
+}
+
+func password_reset_post(w http.ResponseWriter, req *http.Request) {
+	sess := sessionStore.Get(req)
+	token := req.PostFormValue("token")
+	fail := func(notice string) {
+		sess.Notice = notice
+		sessionStore.Set(w, sess)
+		http.Redirect(w, req, "/password/reset?"+url.Values{"token": {token}}.Encode(), 302)
+	}
+	user := resetTokens.user(token, clock.Now(), false)
+	password := req.PostFormValue("new_password")
+	switch {
+	case user == nil:
+	case password != req.PostFormValue("new_password_confirm"):
+		fail(errPasswordMismatch.Error())
+		return
+	default:
+		if err := checkPasswordPolicy(user, password); err != nil {
+			fail(err.Error())
+			return
+		}
+		// Taking the token before the change makes it single-use even
+		// when two posts race.
+		user = resetTokens.user(token, clock.Now(), true)
+	}
+	if user == nil {
+		sess.Notice = invalidResetNotice
+		sessionStore.Set(w, sess)
+		http.Redirect(w, req, "/", 302)
+		return
+	}
+	if err := changePassword(user, password); err != nil {
+		logger.Error("save password", "login", user.Login, "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// The reset unlocks the user by going into login_log, so the unlock
+	// survives rebuilding the history.
+	loginGate.RLock()
+	recordReset(user)
+	loginGate.RUnlock()
+	sessionStore.DropUser(user.ID, "")
+	securityEvent("password_reset", "login", user.Login, "ip", clientIP(req))
+	sess.UserId, sess.MFAUserId = 0, 0
+	sess.Notice = "Your password has been reset. Please log in."
+	sessionStore.Set(w, sess)
+	http.Redirect(w, req, "/", 302)
+}
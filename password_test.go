@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withPasswordFile saves changed passwords to a temporary file while f runs.
+func withPasswordFile(t *testing.T, f func()) {
+	saved, savedHashes, savedIterations := passwordFile, passwordHashes, passwordIterations
+	passwordFile, passwordHashes, passwordIterations = filepath.Join(t.TempDir(), "passwords.tsv"), nil, 1000
+	defer func() { passwordFile, passwordHashes, passwordIterations = saved, savedHashes, savedIterations }()
+	f()
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	u := &User{ID: 1, Login: "alice", password: "current1"}
+	for _, c := range []struct {
+		password string
+		ok       bool
+	}{
+		{"short1", false},
+		{"longenough", false},
+		{"12345678", false},
+		{"xxalice99", false},
+		{"xxALICE99", false},
+		{"current1", false},
+		{"long enough", true},
+		{"longenough1", true},
+		{"ぱすわーど１２３", true},
+		{strings.Repeat("a1", passwordMaxLength), false},
+	} {
+		if err := checkPasswordPolicy(u, c.password); (err == nil) != c.ok {
+			t.Errorf("%q: %v", c.password, err)
+		}
+	}
+}
+
+func TestPasswordChange(t *testing.T) {
+	loadTestTemplates(t)
+	withPasswordFile(t, func() {
+		withLoginEnv([]*User{{ID: 1, Login: "alice", password: "pw"}}, func() {
+			mux := newPublicMux()
+			login := func(password string) *http.Cookie {
+				w := postLogin(mux, nil, url.Values{"login": {"alice"}, "password": {password}})
+				if w.Header().Get("Location") != "/mypage" {
+					return nil
+				}
+				return w.Result().Cookies()[0]
+			}
+			cookie, other := login("pw"), login("pw")
+			if w := getWithCookie(mux, "/mypage/password", cookie); w.Code != 200 || !strings.Contains(w.Body.String(), `name="current_password"`) {
+				t.Fatalf("form: %d\n%s", w.Code, w.Body)
+			}
+			change := func(current, password, confirm string) string {
+				w := postForm(mux, "/mypage/password", cookie, url.Values{
+					"current_password": {current}, "new_password": {password}, "new_password_confirm": {confirm},
+				})
+				if w.Code == 200 {
+					return "changed"
+				}
+				// The notice shows on the page redirected to.
+				body := getWithCookie(mux, w.Header().Get("Location"), cookie).Body.String()
+				if i := strings.Index(body, `role="alert">`); i >= 0 {
+					return body[i+len(`role="alert">`) : i+strings.Index(body[i:], "<")]
+				}
+				return w.Header().Get("Location")
+			}
+
+			if got := change("wrong", "new password", "new password"); got != "Wrong password" {
+				t.Errorf("wrong current password: %s", got)
+			}
+			if n := loginHistory.ByName("alice").failures; n != 1 {
+				t.Errorf("wrong current password counted %d times", n)
+			}
+			if got := change("pw", "new password", "new passw0rd"); got != errPasswordMismatch.Error() {
+				t.Errorf("mismatch: %s", got)
+			}
+			if got := change("pw", "simple", "simple"); !strings.Contains(got, "at least") {
+				t.Errorf("short: %s", got)
+			}
+			if got := change("pw", "new password", "new password"); got != "changed" {
+				t.Fatalf("change: %s", got)
+			}
+
+			if login("pw") != nil {
+				t.Error("old password still works")
+			}
+			if login("new password") == nil {
+				t.Error("new password does not work")
+			}
+			if w := getWithCookie(mux, "/mypage", cookie); w.Code != 200 {
+				t.Errorf("changing session logged out: %d", w.Code)
+			}
+			if w := getWithCookie(mux, "/mypage", other); w.Code != 302 {
+				t.Errorf("other session still logged in: %d", w.Code)
+			}
+
+			// The change survives a restart.
+			u := &User{ID: 1, Login: "alice", password: "pw"}
+			userRepository.Add(u)
+			if err := loadPasswords(passwordFile); err != nil {
+				t.Fatal(err)
+			}
+			if u.checkPassword("pw") || !u.checkPassword("new password") {
+				t.Error("changed password not reloaded")
+			}
+		})
+	})
+}
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 7914, section 11.
+	for _, c := range []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56"},
+	} {
+		if got := hex.EncodeToString(pbkdf2SHA256([]byte(c.password), []byte(c.salt), c.iterations)); got != c.want {
+			t.Errorf("%s/%s/%d = %s", c.password, c.salt, c.iterations, got)
+		}
+	}
+}
+
+func TestLoadPasswordSchemes(t *testing.T) {
+	withPasswordFile(t, func() {
+		withLoginEnv([]*User{{ID: 1, Login: "alice", password: "pw"}, {ID: 2, Login: "bob", password: "pw"}}, func() {
+			// alice from before schemes were tagged, bob since.
+			lines := "alice\tsalt\t" + calcPassHash("old password", "salt") + "\n" +
+				"bob\tpbkdf2-sha256:10\tsalt\t" + hashPassword("pbkdf2-sha256:10", "new password", "salt") + "\n"
+			must(os.WriteFile(passwordFile, []byte(lines), 0644))
+			if err := loadPasswords(passwordFile); err != nil {
+				t.Fatal(err)
+			}
+			if !userRepository.ByName("alice").checkPassword("old password") || !userRepository.ByName("bob").checkPassword("new password") {
+				t.Error("saved password rejected")
+			}
+
+			// Changing bob's password keeps alice's line as it was.
+			if err := changePassword(userRepository.ByName("bob"), "other password1"); err != nil {
+				t.Fatal(err)
+			}
+			b, err := os.ReadFile(passwordFile)
+			must(err)
+			if !strings.HasPrefix(string(b), strings.SplitN(lines, "\n", 2)[0]+"\n") || !strings.Contains(string(b), "bob\tpbkdf2-sha256:1000\t") {
+				t.Errorf("saved:\n%s", b)
+			}
+
+			must(os.WriteFile(passwordFile, []byte("alice\tmd5\tsalt\thash\n"), 0644))
+			if err := loadPasswords(passwordFile); err == nil {
+				t.Error("unknown scheme accepted")
+			}
+		})
+	})
+}
+
+func TestPasswordChangeLocked(t *testing.T) {
+	loadTestTemplates(t)
+	withPasswordFile(t, func() {
+		withLoginEnv([]*User{{ID: 1, Login: "alice", password: "pw"}}, func() {
+			mux := newPublicMux()
+			cookie := postLogin(mux, nil, url.Values{"login": {"alice"}, "password": {"pw"}}).Result().Cookies()[0]
+			form := url.Values{"current_password": {"wrong"}, "new_password": {"new password"}, "new_password_confirm": {"new password"}}
+			for i := 0; i < UserLockThreshold; i++ {
+				postForm(mux, "/mypage/password", cookie, form)
+			}
+			form.Set("current_password", "pw")
+			if w := postForm(mux, "/mypage/password", cookie, form); w.Header().Get("Location") != "/" {
+				t.Fatalf("locked user changed password: %d %s", w.Code, w.Header().Get("Location"))
+			}
+			if !userRepository.ByName("alice").checkPassword("pw") {
+				t.Error("password changed")
+			}
+		})
+	})
+}
+
+func TestPasswordChangeBanned(t *testing.T) {
+	loadTestTemplates(t)
+	withPasswordFile(t, func() {
+		withLoginEnv([]*User{{ID: 1, Login: "alice", password: "pw"}}, func() {
+			mux := newPublicMux()
+			cookie := postLogin(mux, nil, url.Values{"login": {"alice"}, "password": {"pw"}}).Result().Cookies()[0]
+			for i := 0; i < IPBanThreshold; i++ {
+				postLogin(mux, nil, url.Values{"login": {"nobody"}, "password": {"x"}})
+			}
+			form := url.Values{"current_password": {"pw"}, "new_password": {"new password"}, "new_password_confirm": {"new password"}}
+			if w := postForm(mux, "/mypage/password", cookie, form); w.Header().Get("Location") != "/" {
+				t.Fatalf("banned address changed password: %d %s", w.Code, w.Header().Get("Location"))
+			}
+			if !userRepository.ByName("alice").checkPassword("pw") {
+				t.Error("password changed")
+			}
+		})
+	})
+}
+
+func TestPasswordReset(t *testing.T) {
+	loadTestTemplates(t)
+	fc := newFakeClock(time.Unix(1400000000, 0))
+	saved := resetTokens
+	resetTokens = newResetTokenStore(time.Hour)
+	defer func() { resetTokens = saved }()
+
+	withClock(fc, func() {
+		withPasswordFile(t, func() {
+			withLoginEnv([]*User{{ID: 1, Login: "alice", password: "pw"}}, func() {
+				mux, admin := newPublicMux(), newAdminMux()
+				issue := func() string {
+					w := postForm(admin, "/password-reset", nil, url.Values{"login": {"alice"}})
+					var r map[string]string
+					if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil || !strings.HasPrefix(r["url"], "/password/reset?token=") {
+						t.Fatalf("issue: %d %s", w.Code, w.Body)
+					}
+					return strings.TrimPrefix(r["url"], "/password/reset?token=")
+				}
+				reset := func(token, password string) string {
+					w := postForm(mux, "/password/reset", nil, url.Values{"token": {token}, "new_password": {password}, "new_password_confirm": {password}})
+					return w.Header().Get("Location")
+				}
+				if w := postForm(admin, "/password-reset", nil, url.Values{"login": {"nobody"}}); w.Code != http.StatusNotFound {
+					t.Errorf("unknown user: %d", w.Code)
+				}
+
+				for i := 0; i < UserLockThreshold; i++ {
+					postLogin(mux, nil, url.Values{"login": {"alice"}, "password": {"wrong"}})
+				}
+				if locked, _ := isLockedUser(userRepository.ByName("alice")); !locked {
+					t.Fatal("not locked")
+				}
+
+				replaced := issue()
+				token := issue()
+				if w := serve(mux, "GET", "/password/reset?token="+token); w.Code != 200 || !strings.Contains(w.Body.String(), token) {
+					t.Fatalf("form: %d\n%s", w.Code, w.Body)
+				}
+				if l := reset(replaced, "new password"); l != "/" {
+					t.Errorf("replaced token: %s", l)
+				}
+				if l := reset(token, "simple"); !strings.HasPrefix(l, "/password/reset?") {
+					t.Errorf("weak password: %s", l)
+				}
+				var l string
+				events := captureSecurityEvents(func() { l = reset(token, "new password") })
+				if l != "/" {
+					t.Fatalf("reset: %s", l)
+				}
+				if !strings.Contains(events, "msg=user_unlocked") || !strings.Contains(events, "failures=3") {
+					t.Errorf("no unlock event:\n%s", events)
+				}
+				if st := loginHistory.ByName("alice"); st.last != nil {
+					t.Errorf("reset recorded as the last login: %+v", st.last)
+				}
+				if n := loginHistory.ByAddr("192.0.2.1").failures; n != UserLockThreshold {
+					t.Errorf("reset changed the address's failures to %d", n)
+				}
+				for _, addr := range loginHistory.Addrs() {
+					if addr == passwordResetIP {
+						t.Error("reset recorded as an address")
+					}
+				}
+				if locked, _ := isLockedUser(userRepository.ByName("alice")); locked {
+					t.Error("still locked after the reset")
+				}
+				if u := userRepository.ByName("alice"); u.checkPassword("pw") || !u.checkPassword("new password") {
+					t.Error("password not reset")
+				}
+				if l := reset(token, "other password1"); l != "/" || !userRepository.ByName("alice").checkPassword("new password") {
+					t.Error("token used twice")
+				}
+
+				token = issue()
+				fc.Advance(time.Hour)
+				if w := serve(mux, "GET", "/password/reset?token="+token); w.Header().Get("Location") != "/" {
+					t.Errorf("expired token: %d", w.Code)
+				}
+				if reset(token, "other password1"); !userRepository.ByName("alice").checkPassword("new password") {
+					t.Error("expired token reset the password")
+				}
+			})
+		})
+	})
+}
+
+func TestConcurrentPasswordChange(t *testing.T) {
+	withPasswordFile(t, func() {
+		withLoginEnv([]*User{{ID: 1, Login: "alice", password: "pw"}}, func() {
+			u := userRepository.ByName("alice")
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					attemptLogin(loginRequest("alice", "pw", "192.0.2.1"))
+				}()
+				go func() {
+					defer wg.Done()
+					if err := changePassword(u, "new password"); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+			if !u.checkPassword("new password") {
+				t.Error("password not changed")
+			}
+		})
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a set of token buckets keyed by client IP, login name or
+// subnet. Each key may take burst requests at once and then rate per second.
+// At most max keys are tracked; the least recently used bucket is dropped
+// to make room, so a client flooding new keys cannot push out its own.
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	max     int
+	buckets map[string]*list.Element // of *tokenBucket
+	lru     *list.List               // most recently used first
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate, burst float64, max int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: burst, max: max, buckets: make(map[string]*list.Element), lru: list.New()}
+}
+
+// parseRateLimit reads "rate,burst" such as "5,20". An empty spec disables
+// the limiter and returns nil.
+func parseRateLimit(spec string, max int) (*rateLimiter, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	rateStr, burstStr := spec, spec
+	if i := strings.IndexByte(spec, ','); i >= 0 {
+		rateStr, burstStr = spec[:i], spec[i+1:]
+	}
+	rate, err := strconv.ParseFloat(rateStr, 64)
+	if err != nil {
+		return nil, err
+	}
+	burst, err := strconv.ParseFloat(burstStr, 64)
+	if err != nil {
+		return nil, err
+	}
+	return newRateLimiter(rate, burst, max), nil
+}
+
+// refill brings b up to date. l must be locked.
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed*l.rate)
+		b.last = now
+	}
+}
+
+// evict makes room for a new key. l must be locked.
+func (l *rateLimiter) evict() {
+	for len(l.buckets) >= l.max && l.lru.Len() > 0 {
+		b := l.lru.Remove(l.lru.Back()).(*tokenBucket)
+		delete(l.buckets, b.key)
+	}
+}
+
+// allow takes a token for key. When none is left it returns how long until
+// the next one.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	var b *tokenBucket
+	if e := l.buckets[key]; e != nil {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*tokenBucket)
+	} else {
+		l.evict()
+		b = &tokenBucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+	l.refill(b, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.rate <= 0 {
+		return false, time.Hour
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// subnet returns the network of ip used as a rate limit key, or ip itself
+// when it does not parse.
+func subnet(ip string, v4bits, v6bits int) string {
+	p, ok := ipPrefix(ip, v4bits, v6bits)
+	if !ok {
+		return ip
+	}
+	return p.String()
+}
+
+var (
+	loginRateByIP     *rateLimiter
+	loginRateByLogin  *rateLimiter
+	loginRateBySubnet *rateLimiter
+	rateSubnetV4Bits  int
+	rateSubnetV6Bits  int
+)
+
+func initRateLimits() {
+	max, err := strconv.Atoi(getEnv("ISU4_LOGIN_RATE_MAX_KEYS", "100000"))
+	must(err)
+	loginRateByIP, err = parseRateLimit(getEnv("ISU4_LOGIN_RATE_IP", ""), max)
+	must(err)
+	loginRateByLogin, err = parseRateLimit(getEnv("ISU4_LOGIN_RATE_USER", ""), max)
+	must(err)
+	loginRateBySubnet, err = parseRateLimit(getEnv("ISU4_LOGIN_RATE_SUBNET", ""), max)
+	must(err)
+	rateSubnetV4Bits, err = strconv.Atoi(getEnv("ISU4_LOGIN_RATE_SUBNET_V4", "24"))
+	must(err)
+	rateSubnetV6Bits, err = strconv.Atoi(getEnv("ISU4_LOGIN_RATE_SUBNET_V6", "64"))
+	must(err)
+}
+
+// rateLimit rejects requests with 429 before h runs, so throttled attempts
+// are never recorded in login_log.
+func rateLimit(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		now := clock.Now()
+		ip := clientIP(req)
+		var wait time.Duration
+		check := func(l *rateLimiter, key string) {
+			if l == nil {
+				return
+			}
+			if ok, d := l.allow(key, now); !ok && d > wait {
+				wait = d
+			}
+		}
+		check(loginRateByIP, ip)
+		check(loginRateBySubnet, subnet(ip, rateSubnetV4Bits, rateSubnetV6Bits))
+		check(loginRateByLogin, req.PostFormValue("login"))
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		h(w, req)
+	}
+}
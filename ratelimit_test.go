@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := newRateLimiter(2, 3, 100)
+	t0 := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a", t0); !ok {
+			t.Fatalf("burst request %d denied", i)
+		}
+	}
+	ok, wait := l.allow("a", t0)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("after burst: %v %v", ok, wait)
+	}
+	if ok, _ := l.allow("b", t0); !ok {
+		t.Errorf("other key denied")
+	}
+	if ok, _ := l.allow("a", t0.Add(500*time.Millisecond)); !ok {
+		t.Errorf("denied after refill")
+	}
+}
+
+func TestRateLimiterBounded(t *testing.T) {
+	l := newRateLimiter(1, 1, 10)
+	t0 := time.Unix(1000, 0)
+	for i := 0; i < 100; i++ {
+		l.allow(string(rune('a'+i)), t0)
+	}
+	if len(l.buckets) > 10 {
+		t.Errorf("%d buckets, max 10", len(l.buckets))
+	}
+}
+
+func TestRateLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+	l := newRateLimiter(0, 1, 3)
+	t0 := time.Unix(1000, 0)
+	l.allow("attacker", t0)
+	for i := 0; i < 100; i++ {
+		// A flood of new keys, with the attacker's own key kept in use.
+		l.allow(string(rune('a'+i)), t0)
+		if ok, _ := l.allow("attacker", t0); ok {
+			t.Fatalf("attacker's bucket refilled after %d new keys", i+1)
+		}
+	}
+}
+
+func TestSubnet(t *testing.T) {
+	for _, c := range [][2]string{
+		{"192.0.2.77", "192.0.2.0/24"},
+		{"2001:db8::1:2:3:4", "2001:db8::/64"},
+		{"bogus", "bogus"},
+	} {
+		if got := subnet(c[0], 24, 64); got != c[1] {
+			t.Errorf("subnet(%s) = %s, want %s", c[0], got, c[1])
+		}
+	}
+}
+
+func TestRateLimitResponse(t *testing.T) {
+	saved := loginRateByIP
+	defer func() { loginRateByIP = saved }()
+	loginRateByIP = newRateLimiter(0.1, 1, 100)
+
+	h := rateLimit(func(w http.ResponseWriter, r *http.Request) {})
+	codes := []int{}
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		h(rec, loginRequest("alice", "x", "192.0.2.1:1234"))
+		codes = append(codes, rec.Code)
+		if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "10" {
+			t.Errorf("Retry-After = %q", rec.Header().Get("Retry-After"))
+		}
+	}
+	if codes[0] != 200 || codes[1] != http.StatusTooManyRequests {
+		t.Errorf("codes = %v", codes)
+	}
+}
@@ -0,0 +1,272 @@
+// reportcheck replays login_log independently of the webapp and compares the
+// result with what /report says.
+//
+// Usage:
+//
+//	reportcheck [-url http://localhost/report] [-dump login_log.tsv]
+//
+// Without -dump the rows are read from MySQL using the same ISU4_DB_*
+// variables as the app. A dump is the tab separated output of
+//
+//	mysql -B -e 'SELECT id, created_at, user_id, login, ip, succeeded FROM login_log ORDER BY id'
+//
+// The exit status is 0 when /report matches, 1 when it differs and 2 on error.
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type attempt struct {
+	UserId  int // 0 when the login did not match any user
+	Login   string
+	Ip      string
+	Success bool
+}
+
+type streak struct {
+	name     string
+	failures int
+}
+
+// replay applies the same rule as the in-memory LoginHistory: an IP or a
+// user is blocked once it has threshold consecutive failures since its last
+// successful login.
+func replay(attempts []attempt, userLockThreshold, ipBanThreshold int) (bannedIPs, lockedUsers map[string]int) {
+	byAddr := make(map[string]*streak)
+	byUser := make(map[int]*streak)
+	for _, a := range attempts {
+		s := byAddr[a.Ip]
+		if s == nil {
+			s = &streak{name: a.Ip}
+			byAddr[a.Ip] = s
+		}
+		if a.Success {
+			s.failures = 0
+		} else {
+			s.failures++
+		}
+
+		if a.UserId == 0 {
+			continue
+		}
+		s = byUser[a.UserId]
+		if s == nil {
+			s = &streak{name: a.Login}
+			byUser[a.UserId] = s
+		}
+		if a.Success {
+			s.failures = 0
+		} else {
+			s.failures++
+		}
+	}
+
+	bannedIPs = make(map[string]int)
+	for _, s := range byAddr {
+		if s.failures >= ipBanThreshold {
+			bannedIPs[s.name] = s.failures
+		}
+	}
+	lockedUsers = make(map[string]int)
+	for _, s := range byUser {
+		if s.failures >= userLockThreshold {
+			lockedUsers[s.name] = s.failures
+		}
+	}
+	return bannedIPs, lockedUsers
+}
+
+func loadDB(dsn string) ([]attempt, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT `user_id`, `login`, `ip`, `succeeded` FROM login_log ORDER BY `id`")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []attempt
+	for rows.Next() {
+		var id sql.NullInt64
+		var a attempt
+		if err := rows.Scan(&id, &a.Login, &a.Ip, &a.Success); err != nil {
+			return nil, err
+		}
+		if id.Valid {
+			a.UserId = int(id.Int64)
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// loadDump reads `mysql -B` output. The header line is optional and NULL
+// user_id is written as "NULL".
+func loadDump(r io.Reader) ([]attempt, error) {
+	var attempts []attempt
+	sc := bufio.NewScanner(r)
+	lineno := 0
+	for sc.Scan() {
+		lineno++
+		line := sc.Text()
+		if line == "" || (lineno == 1 && strings.HasPrefix(line, "id\t")) {
+			continue
+		}
+		f := strings.Split(line, "\t")
+		if len(f) != 6 {
+			return nil, fmt.Errorf("line %d: expected 6 fields, got %d", lineno, len(f))
+		}
+		a := attempt{Login: f[3], Ip: f[4]}
+		if f[2] != "NULL" {
+			id, err := strconv.Atoi(f[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: user_id: %v", lineno, err)
+			}
+			a.UserId = id
+		}
+		switch f[5] {
+		case "1":
+			a.Success = true
+		case "0":
+		default:
+			return nil, fmt.Errorf("line %d: succeeded: %q", lineno, f[5])
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, sc.Err()
+}
+
+func fetchReport(url string) (map[string][]string, error) {
+	res, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	report := make(map[string][]string)
+	if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+		return nil, fmt.Errorf("GET %s: %v", url, err)
+	}
+	return report, nil
+}
+
+// diff prints the entries that differ between the replay and the report and
+// returns how many there were.
+func diff(w io.Writer, key string, expected map[string]int, reported []string) int {
+	seen := make(map[string]bool)
+	var missing, unexpected []string
+	for _, s := range reported {
+		if seen[s] {
+			unexpected = append(unexpected, s+" (duplicated)")
+			continue
+		}
+		seen[s] = true
+		if _, ok := expected[s]; !ok {
+			unexpected = append(unexpected, s)
+		}
+	}
+	for s, n := range expected {
+		if !seen[s] {
+			missing = append(missing, fmt.Sprintf("%s (%d consecutive failures)", s, n))
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(unexpected)
+
+	if len(missing)+len(unexpected) == 0 {
+		fmt.Fprintf(w, "%s: OK (%d)\n", key, len(expected))
+		return 0
+	}
+	fmt.Fprintf(w, "%s: %d missing from /report, %d unexpected\n", key, len(missing), len(unexpected))
+	for _, s := range missing {
+		fmt.Fprintf(w, "  - %s\n", s)
+	}
+	for _, s := range unexpected {
+		fmt.Fprintf(w, "  + %s\n", s)
+	}
+	return len(missing) + len(unexpected)
+}
+
+func getEnv(key string, def string) string {
+	v := os.Getenv(key)
+	if len(v) == 0 {
+		return def
+	}
+	return v
+}
+
+func getEnvInt(key string, def int) int {
+	n, err := strconv.Atoi(getEnv(key, strconv.Itoa(def)))
+	if err != nil {
+		fatal(fmt.Errorf("%s: %v", key, err))
+	}
+	return n
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "reportcheck:", err)
+	os.Exit(2)
+}
+
+func main() {
+	defaultDSN := fmt.Sprintf(
+		"%s:%s@unix(/var/lib/mysql/mysql.sock)/%s?parseTime=true&loc=Local",
+		getEnv("ISU4_DB_USER", "root"),
+		getEnv("ISU4_DB_PASSWORD", ""),
+		getEnv("ISU4_DB_NAME", "isu4_qualifier"),
+	)
+	url := flag.String("url", "http://localhost/report", "URL of the /report endpoint")
+	dump := flag.String("dump", "", "read login_log from a `mysql -B` dump instead of the database")
+	dsn := flag.String("dsn", defaultDSN, "MySQL data source name")
+	userLock := flag.Int("user-lock-threshold", getEnvInt("ISU4_USER_LOCK_THRESHOLD", 3), "consecutive failures that lock a user")
+	ipBan := flag.Int("ip-ban-threshold", getEnvInt("ISU4_IP_BAN_THRESHOLD", 10), "consecutive failures that ban an IP")
+	flag.Parse()
+
+	var attempts []attempt
+	var err error
+	if *dump != "" {
+		var f *os.File
+		f, err = os.Open(*dump)
+		if err != nil {
+			fatal(err)
+		}
+		attempts, err = loadDump(f)
+		f.Close()
+	} else {
+		attempts, err = loadDB(*dsn)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	report, err := fetchReport(*url)
+	if err != nil {
+		fatal(err)
+	}
+
+	bannedIPs, lockedUsers := replay(attempts, *userLock, *ipBan)
+	fmt.Printf("replayed %d attempts\n", len(attempts))
+	n := diff(os.Stdout, "banned_ips", bannedIPs, report["banned_ips"])
+	n += diff(os.Stdout, "locked_users", lockedUsers, report["locked_users"])
+	if n > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const dump = `id	created_at	user_id	login	ip	succeeded
+1	2014-09-27 10:00:00	1	alice	10.0.0.1	0
+2	2014-09-27 10:00:01	1	alice	10.0.0.1	0
+3	2014-09-27 10:00:02	1	alice	10.0.0.2	1
+4	2014-09-27 10:00:03	NULL	nobody	10.0.0.1	0
+5	2014-09-27 10:00:04	2	bob	10.0.0.1	0
+6	2014-09-27 10:00:05	2	bob	10.0.0.2	0
+7	2014-09-27 10:00:06	2	bob	10.0.0.3	0
+`
+
+func TestReplay(t *testing.T) {
+	attempts, err := loadDump(strings.NewReader(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 7 {
+		t.Fatalf("loaded %d attempts", len(attempts))
+	}
+
+	bannedIPs, lockedUsers := replay(attempts, 3, 4)
+	if len(bannedIPs) != 1 || bannedIPs["10.0.0.1"] != 4 {
+		t.Errorf("bannedIPs = %v", bannedIPs)
+	}
+	// alice's failures are reset by her success; unknown logins never lock.
+	if len(lockedUsers) != 1 || lockedUsers["bob"] != 3 {
+		t.Errorf("lockedUsers = %v", lockedUsers)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	var buf bytes.Buffer
+	n := diff(&buf, "locked_users", map[string]int{"alice": 3, "bob": 5}, []string{"bob", "carol"})
+	if n != 2 {
+		t.Errorf("diff = %d", n)
+	}
+	want := "locked_users: 1 missing from /report, 1 unexpected\n" +
+		"  - alice (3 consecutive failures)\n" +
+		"  + carol\n"
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// allowMethods lets only the given methods reach h and answers others with
+// 405 and an Allow header. Allowing GET also allows HEAD.
+func allowMethods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
+	for _, m := range methods {
+		if m == "GET" {
+			methods = append(methods, "HEAD")
+			break
+		}
+	}
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, req *http.Request) {
+		for _, m := range methods {
+			if req.Method == m {
+				h(w, req)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		errorPage(w, http.StatusMethodNotAllowed)
+	}
+}
+
+// methodSwitch sends POST requests to post and the rest to get, for pages
+// that are both a form and its target. Wrap it in allowMethods.
+func methodSwitch(get, post http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "POST" {
+			post(w, req)
+			return
+		}
+		get(w, req)
+	}
+}
+
+func notFound(w http.ResponseWriter, req *http.Request) {
+	errorPage(w, http.StatusNotFound)
+}
+
+var errorMessages = map[int]string{
+	http.StatusForbidden:        "ページの有効期限が切れました。ログイン画面からやり直してください。",
+	http.StatusNotFound:         "お探しのページは見つかりませんでした。",
+	http.StatusMethodNotAllowed: "このページはご利用いただけない方法で要求されました。",
+}
+
+// errorPage writes the error template for status, or plain text when the
+// templates are not loaded.
+func errorPage(w http.ResponseWriter, status int) {
+	title := strconv.Itoa(status) + " " + http.StatusText(status)
+	if currentTemplates()["error"] == nil {
+		http.Error(w, title, status)
+		return
+	}
+	renderStatus(w, status, "error", errorPageData{Title: title, Message: errorMessages[status]})
+}
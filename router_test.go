@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRouting(t *testing.T) {
+	loadTestTemplates(t)
+	mux := newPublicMux()
+	for _, c := range []struct {
+		method, path string
+		code         int
+		allow        string
+	}{
+		{"GET", "/", 200, ""},
+		{"HEAD", "/", 200, ""},
+		{"POST", "/", 405, "GET, HEAD"},
+		{"GET", "/login", 405, "POST"},
+		{"PUT", "/login", 405, "POST"},
+		{"POST", "/mypage", 405, "GET, HEAD"},
+		{"DELETE", "/report", 405, "GET, HEAD"},
+		{"POST", "/stylesheets/isucon-bank.css", 405, "GET, HEAD"},
+		{"GET", "/stylesheets/isucon-bank.css", 200, ""},
+		{"GET", "/nope", 404, ""},
+		{"POST", "/nope", 404, ""},
+		{"GET", "/index.html", 404, ""},
+		{"GET", "/login/", 404, ""},
+	} {
+		w := serve(mux, c.method, c.path)
+		if w.Code != c.code || w.Header().Get("Allow") != c.allow {
+			t.Errorf("%s %s: %d Allow %q, want %d %q", c.method, c.path, w.Code, w.Header().Get("Allow"), c.code, c.allow)
+		}
+		if c.code >= 400 && !strings.Contains(w.Body.String(), "<html>") {
+			t.Errorf("%s %s: not an HTML error page:\n%s", c.method, c.path, w.Body)
+		}
+	}
+}
+
+func TestStrayLoginNotRecorded(t *testing.T) {
+	loadTestTemplates(t)
+	mux := newPublicMux()
+	withLoginEnv([]*User{{ID: 1, Login: "alice", password: "pw"}}, func() {
+		for _, method := range []string{"GET", "HEAD", "PUT", "DELETE"} {
+			req := httptest.NewRequest(method, "/login?"+url.Values{"login": {"alice"}, "password": {"x"}}.Encode(), nil)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != 405 {
+				t.Errorf("%s /login: %d", method, w.Code)
+			}
+		}
+		if _, _, _, entries := loginHistory.Size(); entries != 0 {
+			t.Errorf("%d attempts recorded", entries)
+		}
+		if got := loginHistory.ByName("alice").failures; got != 0 {
+			t.Errorf("alice has %d failures", got)
+		}
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// simulate replays script against the login code with a fake clock, so
+// runs are deterministic however time-dependent the rules are. One command
+// per line, "#" starts a comment:
+//
+//	advance <duration>
+//	login <name> <password> <ip> <result>   result from loginResultNames, or "throttled"
+//	locked <name> true|false
+//	banned <ip> true|false
+//	lastlogin <name> <ip> <offset>          offset from the start
+//	lastlogin <name> none
+func simulate(t *testing.T, users []*User, script string) {
+	t.Helper()
+	start := time.Unix(1400000000, 0)
+	fc := newFakeClock(start)
+
+	withClock(fc, func() {
+		withLoginEnv(users, func() {
+			sc := bufio.NewScanner(strings.NewReader(script))
+			lineno := 0
+			for sc.Scan() {
+				lineno++
+				line := sc.Text()
+				if i := strings.IndexByte(line, '#'); i >= 0 {
+					line = line[:i]
+				}
+				f := strings.Fields(line)
+				if len(f) == 0 {
+					continue
+				}
+				fail := func(format string, args ...interface{}) {
+					t.Helper()
+					t.Fatalf("line %d %q: "+format, append([]interface{}{lineno, sc.Text()}, args...)...)
+				}
+				switch {
+				case f[0] == "advance" && len(f) == 2:
+					d, err := time.ParseDuration(f[1])
+					if err != nil {
+						fail("%v", err)
+					}
+					fc.Advance(d)
+				case f[0] == "login" && len(f) == 5:
+					got := "throttled"
+					rateLimit(func(w http.ResponseWriter, req *http.Request) {
+						_, err := attemptLogin(req)
+						got = loginResultNames[loginResult(err)]
+					})(httptest.NewRecorder(), loginRequest(f[1], f[2], f[3]))
+					if got != f[4] {
+						fail("got %s", got)
+					}
+				case f[0] == "locked" && len(f) == 3:
+					got, _ := isLockedUser(userRepository.ByName(f[1]))
+					if strconv.FormatBool(got) != f[2] {
+						fail("got %v", got)
+					}
+				case f[0] == "banned" && len(f) == 3:
+					got, _ := isBannedIP(f[1])
+					if strconv.FormatBool(got) != f[2] {
+						fail("got %v", got)
+					}
+				case f[0] == "lastlogin" && (len(f) == 3 || len(f) == 4):
+					u := userRepository.ByName(f[1])
+					l := u.getLastLogin()
+					if len(f) == 3 {
+						if l != nil {
+							fail("got %+v", l)
+						}
+						break
+					}
+					d, err := time.ParseDuration(f[3])
+					if err != nil {
+						fail("%v", err)
+					}
+					if l == nil || l.IP != f[2] || !l.CreatedAt.Equal(start.Add(d)) {
+						fail("got %+v", l)
+					}
+				default:
+					fail("unknown command")
+				}
+			}
+		})
+	})
+}
+
+func TestSimulateLockout(t *testing.T) {
+	users := []*User{
+		{ID: 1, Login: "alice", password: "pw"},
+		{ID: 2, Login: "bob", password: "pw"},
+	}
+	simulate(t, users, `
+		login alice pw 192.0.2.1 success
+		advance 1m
+		login alice pw 192.0.2.2 success
+		lastlogin alice 192.0.2.1 0s
+
+		# three failures lock alice for good
+		login alice x 192.0.2.3 wrong_password
+		login alice x 192.0.2.3 wrong_password
+		advance 1h
+		login alice x 192.0.2.3 wrong_password
+		locked alice true
+		advance 24h
+		login alice pw 192.0.2.4 locked_user
+		lastlogin alice 192.0.2.1 0s
+
+		# 192.0.2.3 is banned after ten failures in a row
+		login bob x 192.0.2.3 wrong_password
+		login bob pw 192.0.2.3 success
+		banned 192.0.2.3 false
+		login nobody x 192.0.2.3 user_not_found
+		login nobody x 192.0.2.3 user_not_found
+		login nobody x 192.0.2.3 user_not_found
+		login nobody x 192.0.2.3 user_not_found
+		login nobody x 192.0.2.3 user_not_found
+		login nobody x 192.0.2.3 user_not_found
+		login nobody x 192.0.2.3 user_not_found
+		login nobody x 192.0.2.3 user_not_found
+		login nobody x 192.0.2.3 user_not_found
+		banned 192.0.2.3 false
+		login nobody x 192.0.2.3 user_not_found
+		banned 192.0.2.3 true
+		login bob pw 192.0.2.3 banned_ip
+		lastlogin bob none
+	`)
+}
+
+func TestSimulateRateLimit(t *testing.T) {
+	saved := loginRateByIP
+	loginRateByIP = newRateLimiter(1, 2, 100)
+	defer func() { loginRateByIP = saved }()
+
+	simulate(t, []*User{{ID: 1, Login: "alice", password: "pw"}}, `
+		login alice pw 192.0.2.1 success
+		login alice pw 192.0.2.1 success
+		login alice pw 192.0.2.1 throttled
+		login alice pw 192.0.2.2 success
+		advance 999ms
+		login alice pw 192.0.2.1 throttled
+		advance 1ms
+		login alice pw 192.0.2.1 success
+	`)
+}
+
+func TestSimulateStuffing(t *testing.T) {
+	saved := stuffing
+	stuffing = newStuffingDetector([]byte("k"), 10*time.Minute, 3, 100, 1000, true)
+	defer func() { stuffing = saved }()
+
+	simulate(t, []*User{{ID: 1, Login: "alice", password: "pw"}}, `
+		login u1 x 192.0.2.1 user_not_found
+		login u2 x 192.0.2.1 user_not_found
+		advance 10m
+		# a new window
+		login u3 x 192.0.2.1 user_not_found
+		login u4 x 192.0.2.1 user_not_found
+		login alice pw 192.0.2.1 success
+		login u5 x 192.0.2.1 user_not_found
+		login alice pw 192.0.2.1 banned_ip
+		advance 9m59s
+		login alice pw 192.0.2.1 banned_ip
+		advance 10m
+		login alice pw 192.0.2.1 success
+	`)
+}
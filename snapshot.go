@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A snapshot is a compact binary copy of LoginHistory together with the
+// login_log rows it contains, so startup only has to read newer rows: every
+// row up to lastId, plus the later rows listed in extra, which were still
+// being written when the copy was taken. The login and created_at of row
+// lastId are kept to check that login_log is still the table it was taken
+// from.
+//
+//	"ISU4HIST" uvarint(version) varint(lastId) str(login) varint(unix seconds)
+//	uvarint(extras) extras * varint(id)
+//	uvarint(v4 bits) uvarint(v6 bits) uvarint(entries)
+//	uvarint(names) names * state
+//	uvarint(addrs) addrs * state
+//	uvarint(prefixes) prefixes * state
+//	crc32(everything above), big endian
+//
+//	state = str(key) uvarint(failures) login(last) login(prev)
+//	login = byte(0) | byte(1) varint(user id) str(ip) str(login) byte(success) varint(unix nano)
+//
+// str is a uvarint length followed by the bytes. The ban prefix lengths are
+// recorded because the prefix index is only valid for the lengths it was
+// built with.
+
+const (
+	snapshotMagic   = "ISU4HIST"
+	snapshotVersion = 5
+)
+
+var errBadSnapshot = errors.New("snapshot: corrupt or unsupported")
+
+// snapshotPos says which login_log rows a snapshot holds.
+type snapshotPos struct {
+	lastId int64
+	extra  []int64 // rows after lastId that are held too
+	login  string  // of row lastId
+	at     int64   // created_at of row lastId, in unix seconds
+}
+
+var (
+	snapshotPath string     // ISU4_SNAPSHOT_PATH, "" when off
+	snapshotMu   sync.Mutex // keeps resets from racing a snapshot being written
+)
+
+type snapshotWriter struct {
+	bytes.Buffer
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *snapshotWriter) uvarint(v uint64) {
+	w.Write(w.tmp[:binary.PutUvarint(w.tmp[:], v)])
+}
+
+func (w *snapshotWriter) varint(v int64) {
+	w.Write(w.tmp[:binary.PutVarint(w.tmp[:], v)])
+}
+
+func (w *snapshotWriter) str(s string) {
+	w.uvarint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+func (w *snapshotWriter) login(l *UserLogin) {
+	if l == nil {
+		w.WriteByte(0)
+		return
+	}
+	w.WriteByte(1)
+	w.varint(int64(l.Id))
+	w.str(l.Ip)
+	w.str(l.Login)
+	if l.Success {
+		w.WriteByte(1)
+	} else {
+		w.WriteByte(0)
+	}
+	w.varint(l.CreatedAt.UnixNano())
+}
+
+// index writes x; the caller holds every shard lock.
+func (w *snapshotWriter) index(x *shardedIndex) {
+	n := 0
+	for i := range x {
+		n += len(x[i].m)
+	}
+	w.uvarint(uint64(n))
+	for i := range x {
+		for key, st := range x[i].m {
+			w.str(key)
+			w.uvarint(uint64(st.failures))
+			w.login(st.last)
+			w.login(st.prev)
+		}
+	}
+}
+
+// encodeSnapshot serializes h. The caller must make sure h holds exactly the
+// login_log rows pos names.
+func encodeSnapshot(h *LoginHistory, pos snapshotPos) []byte {
+	w := &snapshotWriter{}
+	w.WriteString(snapshotMagic)
+	w.uvarint(snapshotVersion)
+	w.varint(pos.lastId)
+	w.str(pos.login)
+	w.varint(pos.at)
+	w.uvarint(uint64(len(pos.extra)))
+	for _, id := range pos.extra {
+		w.varint(id)
+	}
+	w.uvarint(uint64(banPrefixV4Bits))
+	w.uvarint(uint64(banPrefixV6Bits))
+
+	h.lockAll()
+	w.uvarint(uint64(atomic.LoadInt64(&h.entries)))
+	for _, x := range h.indexes() {
+		w.index(x)
+	}
+	h.unlockAll()
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(w.Bytes()))
+	w.Write(sum[:])
+	return w.Bytes()
+}
+
+type snapshotReader struct {
+	*bytes.Reader
+	err error
+}
+
+func (r *snapshotReader) uvarint() uint64 {
+	v, err := binary.ReadUvarint(r)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	return v
+}
+
+func (r *snapshotReader) varint() int64 {
+	v, err := binary.ReadVarint(r)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	return v
+}
+
+func (r *snapshotReader) str() string {
+	n := r.uvarint()
+	if r.err != nil || n > uint64(r.Len()) {
+		r.err = errBadSnapshot
+		return ""
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return string(b)
+}
+
+func (r *snapshotReader) byte() byte {
+	b, err := r.ReadByte()
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	return b
+}
+
+func (r *snapshotReader) login() *UserLogin {
+	if r.byte() != 1 {
+		return nil
+	}
+	l := &UserLogin{Id: int(r.varint())}
+	l.Ip = r.str()
+	l.Login = r.str()
+	l.Success = r.byte() == 1
+	l.CreatedAt = time.Unix(0, r.varint())
+	return l
+}
+
+// index fills x, which must not be shared yet.
+func (r *snapshotReader) index(x *shardedIndex) {
+	n := r.uvarint()
+	if n > uint64(r.Len()) {
+		r.err = errBadSnapshot
+		return
+	}
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		key := r.str()
+		st := &loginState{failures: int(r.uvarint())}
+		st.last = r.login()
+		st.prev = r.login()
+		x.shard(key).m[key] = st
+	}
+}
+
+func decodeSnapshot(data []byte) (*LoginHistory, snapshotPos, error) {
+	var pos snapshotPos
+	if len(data) < len(snapshotMagic)+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, pos, errBadSnapshot
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return nil, pos, errBadSnapshot
+	}
+
+	r := &snapshotReader{Reader: bytes.NewReader(body[len(snapshotMagic):])}
+	if r.uvarint() != snapshotVersion {
+		return nil, pos, errBadSnapshot
+	}
+	pos.lastId = r.varint()
+	pos.login = r.str()
+	pos.at = r.varint()
+	n := r.uvarint()
+	if n > uint64(r.Len()) {
+		return nil, pos, errBadSnapshot
+	}
+	for i := uint64(0); i < n; i++ {
+		pos.extra = append(pos.extra, r.varint())
+	}
+	if r.uvarint() != uint64(banPrefixV4Bits) || r.uvarint() != uint64(banPrefixV6Bits) {
+		return nil, pos, errBadSnapshot
+	}
+
+	h := NewLoginHistory()
+	atomic.StoreInt64(&h.entries, int64(r.uvarint()))
+	for _, x := range h.indexes() {
+		r.index(x)
+	}
+	if r.err != nil || r.Len() != 0 {
+		return nil, pos, errBadSnapshot
+	}
+	return h, pos, nil
+}
+
+// takeSnapshot keeps logins out only while it copies the history and notes
+// which of its rows are still being written. It waits for those with
+// logins running again, then writes the copy to path.
+func takeSnapshot(path string) error {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	loginGate.Lock()
+	h := loginHistory.clone()
+	lastId, pending := inserts.mark()
+	loginGate.Unlock()
+	pos := snapshotPos{lastId: lastId, extra: inserts.wait(pending, lastId)}
+	if lastId > 0 {
+		var err error
+		if pos.login, pos.at, err = lastRow(lastId); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(path, encodeSnapshot(h, pos))
+}
+
+// removeSnapshot deletes the snapshot file, if any. snapshotMu must be held.
+func removeSnapshot() error {
+	if snapshotPath == "" {
+		return nil
+	}
+	if err := os.Remove(snapshotPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// snapshotLoop writes a snapshot to ISU4_SNAPSHOT_PATH every
+// ISU4_SNAPSHOT_INTERVAL. It does nothing when the path is empty.
+func snapshotLoop() {
+	path := snapshotPath
+	if path == "" {
+		return
+	}
+	interval, err := time.ParseDuration(getEnv("ISU4_SNAPSHOT_INTERVAL", "1m"))
+	must(err)
+	for {
+		<-clock.After(interval)
+		start := time.Now()
+		if err := takeSnapshot(path); err != nil {
+			logger.Error("snapshot failed", "path", path, "err", err)
+			continue
+		}
+		logger.Debug("snapshot written", "path", path, "duration", time.Since(start))
+	}
+}
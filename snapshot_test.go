@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testHistory() *LoginHistory {
+	h := NewLoginHistory()
+	t0 := time.Date(2014, 9, 27, 10, 0, 0, 0, time.Local)
+	for i, l := range []UserLogin{
+		{Id: 1, Ip: "10.0.0.1", Login: "alice", Success: false},
+		{Id: 2, Ip: "10.0.0.2", Login: "bob", Success: true},
+		{Id: 1, Ip: "10.0.0.2", Login: "alice", Success: true},
+		{Id: 0, Ip: "10.0.0.1", Login: "nobody", Success: false},
+		{Id: 2, Ip: "10.0.0.1", Login: "bob", Success: false},
+	} {
+		l := l
+		l.CreatedAt = t0.Add(time.Duration(i) * time.Second)
+		h.Add(&l)
+	}
+	return h
+}
+
+func sameHistory(a, b *LoginHistory) bool {
+	an, aa, ap, ae := a.Size()
+	bn, ba, bp, be := b.Size()
+	if an != bn || aa != ba || ap != bp || ae != be {
+		return false
+	}
+	for _, name := range a.Names() {
+		if !reflect.DeepEqual(a.ByName(name), b.ByName(name)) {
+			return false
+		}
+	}
+	for _, addr := range a.Addrs() {
+		if !reflect.DeepEqual(a.ByAddr(addr), b.ByAddr(addr)) {
+			return false
+		}
+	}
+	for _, prefix := range a.Prefixes() {
+		if !reflect.DeepEqual(a.ByPrefix(prefix), b.ByPrefix(prefix)) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	h := testHistory()
+	want := snapshotPos{lastId: 42, extra: []int64{44, 43}, login: "alice", at: 1400000000}
+	got, pos, err := decodeSnapshot(encodeSnapshot(h, want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pos, want) {
+		t.Errorf("pos = %+v, want %+v", pos, want)
+	}
+	if !sameHistory(got, h) {
+		t.Errorf("decoded history differs")
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	data := encodeSnapshot(testHistory(), snapshotPos{lastId: 42})
+	for _, b := range [][]byte{
+		nil,
+		data[:len(data)-1],
+		append([]byte("ISU4HISX"), data[8:]...),
+	} {
+		if _, _, err := decodeSnapshot(b); err == nil {
+			t.Errorf("decoded %d corrupt bytes", len(b))
+		}
+	}
+	flipped := append([]byte(nil), data...)
+	flipped[20] ^= 0xff
+	if _, _, err := decodeSnapshot(flipped); err == nil {
+		t.Errorf("checksum mismatch not detected")
+	}
+}
+
+func TestInsertTracker(t *testing.T) {
+	tr := newInsertTracker()
+	tr.reset(10)
+	a, b, c := &UserLogin{}, &UserLogin{}, &UserLogin{}
+	tr.queued(a)
+	tr.queued(b)
+	tr.written(b, 12)
+	lastId, pending := tr.mark()
+	if lastId != 12 || len(pending) != 1 || pending[0] != a {
+		t.Fatalf("mark = %d, %v", lastId, pending)
+	}
+	// c comes after the mark, so it is not waited for; a was allocated
+	// after b and lands after lastId.
+	tr.queued(c)
+	go tr.written(a, 13)
+	if extra := tr.wait(pending, lastId); !reflect.DeepEqual(extra, []int64{13}) {
+		t.Errorf("extra = %v", extra)
+	}
+}
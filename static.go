@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Files under public/ are read into memory when the mux is built. Each is
+// served with a strong ETag, Last-Modified and a Cache-Control policy for
+// its path, and compressed when the client accepts it: gzip is generated
+// for text, brotli only comes from a precompressed "<file>.br" next to the
+// original (as does gzip from "<file>.gz"). http.ServeContent takes care of
+// conditional requests, HEAD and Range.
+//
+// Each file is also served under a fingerprinted name carrying the start of
+// its hash, e.g. /stylesheets/site.3f2a9c1b04de.css, which can be cached
+// forever. Templates link to it with {{ asset "/stylesheets/site.css" }}.
+
+type staticFile struct {
+	name     string
+	hash     string // hex
+	modTime  time.Time
+	ctype    string
+	cache    string
+	variants []staticVariant // preferred first, identity last
+}
+
+type staticVariant struct {
+	encoding string // "" for identity
+	body     []byte
+	etag     string
+}
+
+type cachePolicy struct {
+	prefix string
+	value  string
+}
+
+// staticCachePolicies gives the Cache-Control of a URL by its longest
+// matching prefix.
+var staticCachePolicies = []cachePolicy{
+	{"/images/", "public, max-age=86400"},
+	{"/stylesheets/", "public, max-age=3600"},
+	{"/", "no-cache"},
+}
+
+// parseCachePolicies reads "prefix=value;prefix=value", e.g.
+// "/images/=public, max-age=604800;/=no-cache".
+func parseCachePolicies(spec string) ([]cachePolicy, error) {
+	var policies []cachePolicy
+	for _, rule := range strings.Split(spec, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		i := strings.IndexByte(rule, '=')
+		if i <= 0 || rule[0] != '/' {
+			return nil, fmt.Errorf("cache policy %q: want /prefix=value", rule)
+		}
+		policies = append(policies, cachePolicy{strings.TrimSpace(rule[:i]), strings.TrimSpace(rule[i+1:])})
+	}
+	return policies, nil
+}
+
+func initStaticCache() {
+	spec := getEnv("ISU4_STATIC_CACHE_CONTROL", "")
+	if spec == "" {
+		return
+	}
+	policies, err := parseCachePolicies(spec)
+	must(err)
+	staticCachePolicies = policies
+}
+
+func cacheControl(urlpath string) string {
+	best := -1
+	value := ""
+	for _, p := range staticCachePolicies {
+		if strings.HasPrefix(urlpath, p.prefix) && len(p.prefix) > best {
+			best, value = len(p.prefix), p.value
+		}
+	}
+	return value
+}
+
+func compressible(ctype string) bool {
+	return strings.HasPrefix(ctype, "text/") || strings.Contains(ctype, "javascript") ||
+		strings.Contains(ctype, "json") || strings.Contains(ctype, "xml") || strings.Contains(ctype, "svg")
+}
+
+func gzipBytes(b []byte) []byte {
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func loadStaticFile(path, urlpath string, info os.FileInfo) (*staticFile, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	tag := hex.EncodeToString(sum[:12])
+	f := &staticFile{
+		name:    filepath.Base(path),
+		hash:    tag,
+		modTime: info.ModTime(),
+		ctype:   mime.TypeByExtension(filepath.Ext(path)),
+		cache:   cacheControl(urlpath),
+	}
+	if f.ctype == "" {
+		f.ctype = http.DetectContentType(body)
+	}
+	if br, err := os.ReadFile(path + ".br"); err == nil {
+		f.variants = append(f.variants, staticVariant{"br", br, `"` + tag + `-br"`})
+	}
+	gz, err := os.ReadFile(path + ".gz")
+	if err != nil && compressible(f.ctype) {
+		gz = gzipBytes(body)
+	}
+	if gz != nil && len(gz) < len(body) {
+		f.variants = append(f.variants, staticVariant{"gzip", gz, `"` + tag + `-gzip"`})
+	}
+	f.variants = append(f.variants, staticVariant{"", body, `"` + tag + `"`})
+	return f, nil
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows enc.
+func acceptsEncoding(header, enc string) bool {
+	star := false
+	for _, part := range strings.Split(header, ",") {
+		name, params := strings.TrimSpace(part), ""
+		if i := strings.IndexByte(name, ';'); i >= 0 {
+			name, params = strings.TrimSpace(name[:i]), strings.TrimSpace(name[i+1:])
+		}
+		q := 1.0
+		if strings.HasPrefix(params, "q=") {
+			var err error
+			if q, err = strconv.ParseFloat(params[2:], 64); err != nil {
+				q = 0
+			}
+		}
+		switch strings.ToLower(name) {
+		case enc:
+			return q > 0
+		case "*":
+			star = q > 0
+		}
+	}
+	return star
+}
+
+func (f *staticFile) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v := f.variants[len(f.variants)-1]
+	ae := r.Header.Get("Accept-Encoding")
+	for _, c := range f.variants[:len(f.variants)-1] {
+		if acceptsEncoding(ae, c.encoding) {
+			v = c
+			break
+		}
+	}
+	h := w.Header()
+	if len(f.variants) > 1 {
+		h.Set("Vary", "Accept-Encoding")
+	}
+	if v.encoding != "" {
+		h.Set("Content-Encoding", v.encoding)
+	}
+	h.Set("Content-Type", f.ctype)
+	h.Set("ETag", v.etag)
+	if f.cache != "" {
+		h.Set("Cache-Control", f.cache)
+	}
+	http.ServeContent(w, r, f.name, f.modTime, bytes.NewReader(v.body))
+}
+
+const immutableCache = "public, max-age=31536000, immutable"
+
+var assetURLs atomic.Value // map[string]string, URL path to fingerprinted path
+
+// assetURL returns the fingerprinted path of a static file, or urlpath
+// itself when there is no such file.
+func assetURL(urlpath string) string {
+	return lookupAsset(currentAssets(), urlpath)
+}
+
+func currentAssets() map[string]string {
+	assets, _ := assetURLs.Load().(map[string]string)
+	return assets
+}
+
+func lookupAsset(assets map[string]string, urlpath string) string {
+	if fp, ok := assets[urlpath]; ok {
+		return fp
+	}
+	return urlpath
+}
+
+func fingerprint(urlpath, hash string) string {
+	ext := path.Ext(urlpath)
+	return strings.TrimSuffix(urlpath, ext) + "." + hash[:12] + ext
+}
+
+// staticFiles registers every file under prefix on mux and returns their
+// fingerprinted paths.
+func staticFiles(mux *http.ServeMux, prefix string) map[string]string {
+	assets := make(map[string]string)
+	wf := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			logger.Warn("walk static files", "path", path, "err", err)
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		for _, ext := range []string{".br", ".gz"} {
+			if strings.HasSuffix(path, ext) {
+				if _, err := os.Stat(strings.TrimSuffix(path, ext)); err == nil {
+					// A precompressed copy, served by the original's route.
+					return nil
+				}
+			}
+		}
+		urlpath := filepath.ToSlash(path[len(prefix):])
+		if urlpath == "" || urlpath[0] != '/' {
+			urlpath = "/" + urlpath
+		}
+		f, err := loadStaticFile(path, urlpath, info)
+		if err != nil {
+			logger.Warn("read static file", "path", path, "err", err)
+			return nil
+		}
+		logger.Debug("registering static file", "url", urlpath, "path", path, "type", f.ctype, "variants", len(f.variants))
+		mux.HandleFunc(urlpath, instrument("static", allowMethods(f.ServeHTTP, "GET")))
+		immutable := *f
+		immutable.cache = immutableCache
+		assets[urlpath] = fingerprint(urlpath, f.hash)
+		mux.HandleFunc(assets[urlpath], instrument("static", allowMethods(immutable.ServeHTTP, "GET")))
+		return nil
+	}
+	filepath.Walk(prefix, wf)
+	return assets
+}
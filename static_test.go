@@ -0,0 +1,197 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newStaticMux(t *testing.T) (*http.ServeMux, string) {
+	dir := t.TempDir()
+	css := strings.Repeat("body { color: black; }\n", 100)
+	files := map[string]string{
+		"stylesheets/site.css": css,
+		"images/logo.png":      "\x89PNG\r\n\x1a\n0000",
+		"app.js":               strings.Repeat("var a = 1;\n", 100),
+		"app.js.br":            "brotli",
+		"data.unknownext":      "plain text",
+	}
+	for name, body := range files {
+		path := filepath.Join(dir, name)
+		must(os.MkdirAll(filepath.Dir(path), 0755))
+		must(os.WriteFile(path, []byte(body), 0644))
+	}
+	mux := http.NewServeMux()
+	assetURLs.Store(staticFiles(mux, dir))
+	return mux, css
+}
+
+func serve(h http.Handler, method, path string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestStaticHeaders(t *testing.T) {
+	mux, css := newStaticMux(t)
+	w := serve(mux, "GET", "/stylesheets/site.css")
+	if w.Code != 200 || w.Body.String() != css {
+		t.Fatalf("GET: %d %q", w.Code, w.Body.String()[:10])
+	}
+	h := w.Header()
+	if !strings.HasPrefix(h.Get("Content-Type"), "text/css") {
+		t.Errorf("Content-Type = %q", h.Get("Content-Type"))
+	}
+	if h.Get("ETag") == "" || h.Get("Last-Modified") == "" || h.Get("Content-Encoding") != "" {
+		t.Errorf("headers = %v", h)
+	}
+	if h.Get("Cache-Control") != "public, max-age=3600" || h.Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Cache-Control = %q, Vary = %q", h.Get("Cache-Control"), h.Get("Vary"))
+	}
+	if got := serve(mux, "GET", "/images/logo.png").Header(); got.Get("Content-Type") != "image/png" || got.Get("Cache-Control") != "public, max-age=86400" {
+		t.Errorf("png headers = %v", got)
+	}
+	if got := serve(mux, "GET", "/data.unknownext").Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("sniffed Content-Type = %q", got)
+	}
+	if got := serve(mux, "GET", "/app.js.br").Code; got != 404 {
+		t.Errorf("precompressed copy served on its own: %d", got)
+	}
+}
+
+func TestStaticConditional(t *testing.T) {
+	mux, _ := newStaticMux(t)
+	h := serve(mux, "GET", "/stylesheets/site.css").Header()
+	if w := serve(mux, "GET", "/stylesheets/site.css", "If-None-Match", h.Get("ETag")); w.Code != 304 || w.Body.Len() != 0 {
+		t.Errorf("If-None-Match: %d", w.Code)
+	}
+	if w := serve(mux, "GET", "/stylesheets/site.css", "If-None-Match", `"other"`); w.Code != 200 {
+		t.Errorf("stale If-None-Match: %d", w.Code)
+	}
+	if w := serve(mux, "GET", "/stylesheets/site.css", "If-Modified-Since", h.Get("Last-Modified")); w.Code != 304 {
+		t.Errorf("If-Modified-Since: %d", w.Code)
+	}
+	old := time.Unix(0, 0).UTC().Format(http.TimeFormat)
+	if w := serve(mux, "GET", "/stylesheets/site.css", "If-Modified-Since", old); w.Code != 200 {
+		t.Errorf("old If-Modified-Since: %d", w.Code)
+	}
+}
+
+func TestStaticCompression(t *testing.T) {
+	mux, css := newStaticMux(t)
+	w := serve(mux, "GET", "/stylesheets/site.css", "Accept-Encoding", "gzip, deflate")
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q", w.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(zr); string(b) != css {
+		t.Error("gzip body differs")
+	}
+	if plain := serve(mux, "GET", "/stylesheets/site.css").Header().Get("ETag"); plain == w.Header().Get("ETag") {
+		t.Error("gzip and identity share an ETag")
+	}
+	if got := serve(mux, "GET", "/stylesheets/site.css", "Accept-Encoding", "gzip;q=0").Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("gzip;q=0 got %q", got)
+	}
+
+	// Brotli is only served from a precompressed file.
+	if w := serve(mux, "GET", "/app.js", "Accept-Encoding", "gzip, br"); w.Header().Get("Content-Encoding") != "br" || w.Body.String() != "brotli" {
+		t.Errorf("app.js: %q %q", w.Header().Get("Content-Encoding"), w.Body.String())
+	}
+	if got := serve(mux, "GET", "/stylesheets/site.css", "Accept-Encoding", "br").Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("site.css with br only: %q", got)
+	}
+	// Images are not compressed.
+	if got := serve(mux, "GET", "/images/logo.png", "Accept-Encoding", "gzip").Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("png: %q", got)
+	}
+}
+
+func TestStaticHeadAndRange(t *testing.T) {
+	mux, css := newStaticMux(t)
+	w := serve(mux, "HEAD", "/stylesheets/site.css")
+	if w.Code != 200 || w.Body.Len() != 0 || w.Header().Get("Content-Length") == "" {
+		t.Errorf("HEAD: %d %d %q", w.Code, w.Body.Len(), w.Header().Get("Content-Length"))
+	}
+	w = serve(mux, "GET", "/stylesheets/site.css", "Range", "bytes=5-9")
+	if w.Code != 206 || w.Body.String() != css[5:10] {
+		t.Errorf("Range: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestFingerprintedAssets(t *testing.T) {
+	mux, css := newStaticMux(t)
+	fp := assetURL("/stylesheets/site.css")
+	if fp == "/stylesheets/site.css" || !strings.HasPrefix(fp, "/stylesheets/site.") || !strings.HasSuffix(fp, ".css") {
+		t.Fatalf("assetURL = %q", fp)
+	}
+	w := serve(mux, "GET", fp)
+	if w.Code != 200 || w.Body.String() != css || w.Header().Get("Cache-Control") != immutableCache {
+		t.Errorf("GET %s: %d %q", fp, w.Code, w.Header().Get("Cache-Control"))
+	}
+	if got := assetURL("/nope.css"); got != "/nope.css" {
+		t.Errorf("unknown asset = %q", got)
+	}
+
+	// Pages link to the fingerprinted names.
+	newPublicMux()
+	loadTestTemplates(t)
+	body := renderPage(t, "index", indexPage{})
+	for _, name := range []string{"/stylesheets/bootstrap.min.css", "/images/isucon-bank.png"} {
+		if fp := assetURL(name); fp == name || !strings.Contains(body, `"`+fp+`"`) {
+			t.Errorf("page does not link %s as %s", name, fp)
+		}
+	}
+}
+
+func TestUnknownPathNotFound(t *testing.T) {
+	for _, path := range []string{"/nope", "/stylesheets/nope.css"} {
+		if w := serve(newPublicMux(), "GET", path); w.Code != 404 {
+			t.Errorf("%s: %d", path, w.Code)
+		}
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	for _, c := range []struct {
+		header, enc string
+		want        bool
+	}{
+		{"", "gzip", false},
+		{"gzip", "gzip", true},
+		{"deflate, GZIP", "gzip", true},
+		{"gzip;q=0", "gzip", false},
+		{"gzip;q=0.5", "gzip", true},
+		{"*", "br", true},
+		{"*, br;q=0", "br", false},
+		{"*;q=0", "gzip", false},
+		{"gzip", "br", false},
+	} {
+		if got := acceptsEncoding(c.header, c.enc); got != c.want {
+			t.Errorf("acceptsEncoding(%q, %q) = %v", c.header, c.enc, got)
+		}
+	}
+}
+
+func TestParseCachePolicies(t *testing.T) {
+	p, err := parseCachePolicies("/images/=public, max-age=604800; /=no-cache")
+	if err != nil || len(p) != 2 || p[0] != (cachePolicy{"/images/", "public, max-age=604800"}) {
+		t.Errorf("got %v %v", p, err)
+	}
+	if _, err := parseCachePolicies("images=x"); err == nil {
+		t.Error("accepted a prefix without /")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// stuffingDetector looks for attacks the consecutive-failure rules miss:
+// one address failing on many distinct logins (credential stuffing) and one
+// password failing on many distinct logins (password spraying). Passwords
+// are only kept as a keyed hash. Counts are per fixed window.
+type stuffingDetector struct {
+	sync.Mutex
+	key       []byte
+	window    time.Duration
+	fanout    int  // distinct logins per address
+	spray     int  // distinct logins per password
+	ban       bool // reject flagged addresses
+	maxKeys   int
+	byAddr    map[string]*stuffingWindow
+	byPass    map[[16]byte]*stuffingWindow
+	flagged   map[string]time.Time // address -> flagged until
+	sprayAddr map[[16]byte]map[string]bool
+}
+
+type stuffingWindow struct {
+	start   time.Time
+	logins  map[string]bool
+	flagged bool
+}
+
+func newStuffingDetector(key []byte, window time.Duration, fanout, spray, maxKeys int, ban bool) *stuffingDetector {
+	return &stuffingDetector{
+		key:       key,
+		window:    window,
+		fanout:    fanout,
+		spray:     spray,
+		ban:       ban,
+		maxKeys:   maxKeys,
+		byAddr:    make(map[string]*stuffingWindow),
+		byPass:    make(map[[16]byte]*stuffingWindow),
+		flagged:   make(map[string]time.Time),
+		sprayAddr: make(map[[16]byte]map[string]bool),
+	}
+}
+
+// reset forgets every window and flagged address, for /__reset__.
+func (d *stuffingDetector) reset() {
+	if d == nil {
+		return
+	}
+	d.Lock()
+	d.byAddr = make(map[string]*stuffingWindow)
+	d.byPass = make(map[[16]byte]*stuffingWindow)
+	d.flagged = make(map[string]time.Time)
+	d.sprayAddr = make(map[[16]byte]map[string]bool)
+	d.Unlock()
+}
+
+func (d *stuffingDetector) passwordHash(password string) [16]byte {
+	m := hmac.New(sha256.New, d.key)
+	m.Write([]byte(password))
+	var h [16]byte
+	copy(h[:], m.Sum(nil))
+	return h
+}
+
+// expire drops finished windows once the maps reach maxKeys. d must be
+// locked.
+func (d *stuffingDetector) expire(now time.Time) {
+	if len(d.byAddr)+len(d.byPass)+len(d.flagged) < d.maxKeys {
+		return
+	}
+	for k, w := range d.byAddr {
+		if now.Sub(w.start) >= d.window {
+			delete(d.byAddr, k)
+		}
+	}
+	for k, w := range d.byPass {
+		if now.Sub(w.start) >= d.window {
+			delete(d.byPass, k)
+			delete(d.sprayAddr, k)
+		}
+	}
+	for k, until := range d.flagged {
+		if !now.Before(until) {
+			delete(d.flagged, k)
+		}
+	}
+}
+
+// count adds login to the window w (creating it when nil or finished) and
+// reports whether it just reached threshold. d must be locked.
+func (d *stuffingDetector) count(w *stuffingWindow, login string, threshold int, now time.Time) (*stuffingWindow, bool) {
+	if w == nil || now.Sub(w.start) >= d.window {
+		if w == nil && len(d.byAddr)+len(d.byPass)+len(d.flagged) >= d.maxKeys {
+			return nil, false
+		}
+		w = &stuffingWindow{start: now, logins: make(map[string]bool)}
+	}
+	if w.flagged {
+		return w, false
+	}
+	w.logins[login] = true
+	if len(w.logins) >= threshold {
+		// The set is no longer needed once the window is flagged.
+		w.flagged, w.logins = true, nil
+		return w, true
+	}
+	return w, false
+}
+
+func (d *stuffingDetector) flag(ip string, now time.Time) {
+	if d.ban {
+		d.flagged[ip] = now.Add(d.window)
+	}
+}
+
+// blocked reports whether ip has been flagged and banning is enabled.
+func (d *stuffingDetector) blocked(ip string, now time.Time) bool {
+	if d == nil || !d.ban {
+		return false
+	}
+	d.Lock()
+	until, ok := d.flagged[ip]
+	d.Unlock()
+	return ok && now.Before(until)
+}
+
+// flaggedIPs returns the addresses currently banned for stuffing or
+// spraying.
+func (d *stuffingDetector) flaggedIPs(now time.Time) []string {
+	if d == nil {
+		return nil
+	}
+	d.Lock()
+	ips := make([]string, 0, len(d.flagged))
+	for ip, until := range d.flagged {
+		if now.Before(until) {
+			ips = append(ips, ip)
+		}
+	}
+	d.Unlock()
+	sort.Strings(ips)
+	return ips
+}
+
+// observe records a login attempt. Only failures are counted.
+func (d *stuffingDetector) observe(ip, login, password string, success bool, now time.Time) {
+	if d == nil || success {
+		return
+	}
+	h := d.passwordHash(password)
+
+	d.Lock()
+	defer d.Unlock()
+	d.expire(now)
+
+	w, hit := d.count(d.byAddr[ip], login, d.fanout, now)
+	if w != nil {
+		d.byAddr[ip] = w
+	}
+	if hit {
+		securityEvent("credential_stuffing", "ip", ip, "distinct_logins", d.fanout, "window", d.window)
+		d.flag(ip, now)
+	}
+
+	w, hit = d.count(d.byPass[h], login, d.spray, now)
+	if w == nil {
+		return
+	}
+	if d.byPass[h] != w {
+		delete(d.sprayAddr, h)
+	}
+	d.byPass[h] = w
+	addrs := d.sprayAddr[h]
+	if addrs == nil {
+		addrs = make(map[string]bool)
+		d.sprayAddr[h] = addrs
+	}
+	if hit {
+		securityEvent("password_spraying", "password_hash", hex.EncodeToString(h[:4]),
+			"distinct_logins", d.spray, "ips", len(addrs)+1, "window", d.window)
+		for addr := range addrs {
+			d.flag(addr, now)
+		}
+		d.sprayAddr[h] = nil
+	}
+	if w.flagged {
+		// Everyone still trying a sprayed password is part of the attack.
+		d.flag(ip, now)
+	} else {
+		addrs[ip] = true
+	}
+}
+
+var stuffing *stuffingDetector
+
+func initStuffingDetector() {
+	key := []byte(getEnv("ISU4_STUFFING_KEY", ""))
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		_, err := rand.Read(key)
+		must(err)
+	}
+	window, err := time.ParseDuration(getEnv("ISU4_STUFFING_WINDOW", "10m"))
+	must(err)
+	fanout, err := strconv.Atoi(getEnv("ISU4_STUFFING_FANOUT", "20"))
+	must(err)
+	spray, err := strconv.Atoi(getEnv("ISU4_SPRAY_THRESHOLD", "20"))
+	must(err)
+	maxKeys, err := strconv.Atoi(getEnv("ISU4_STUFFING_MAX_KEYS", "100000"))
+	must(err)
+	if fanout <= 0 && spray <= 0 {
+		return
+	}
+	stuffing = newStuffingDetector(key, window, fanout, spray, maxKeys, getEnv("ISU4_STUFFING_BAN", "") == "1")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStuffingFanout(t *testing.T) {
+	d := newStuffingDetector([]byte("k"), time.Minute, 3, 100, 1000, true)
+	t0 := time.Unix(1000, 0)
+	d.observe("192.0.2.1", "alice", "a", false, t0)
+	d.observe("192.0.2.1", "alice", "b", false, t0)
+	d.observe("192.0.2.1", "bob", "c", false, t0)
+	if d.blocked("192.0.2.1", t0) {
+		t.Fatal("blocked after 2 distinct logins")
+	}
+	d.observe("192.0.2.1", "carol", "d", true, t0)
+	if d.blocked("192.0.2.1", t0) {
+		t.Fatal("success counted")
+	}
+	d.observe("192.0.2.1", "dave", "e", false, t0)
+	if !d.blocked("192.0.2.1", t0) {
+		t.Fatal("not blocked after 3 distinct logins")
+	}
+	if d.blocked("192.0.2.2", t0) {
+		t.Error("other address blocked")
+	}
+	if d.blocked("192.0.2.1", t0.Add(time.Minute)) {
+		t.Error("still blocked after the window")
+	}
+}
+
+func TestStuffingReset(t *testing.T) {
+	d := newStuffingDetector([]byte("k"), time.Minute, 2, 100, 1000, true)
+	t0 := time.Unix(1000, 0)
+	d.observe("192.0.2.1", "alice", "a", false, t0)
+	d.observe("192.0.2.1", "bob", "b", false, t0)
+	if !d.blocked("192.0.2.1", t0) {
+		t.Fatal("not blocked")
+	}
+	d.reset()
+	if d.blocked("192.0.2.1", t0) || len(d.flaggedIPs(t0)) != 0 {
+		t.Error("still flagged after a reset")
+	}
+	d.observe("192.0.2.1", "carol", "c", false, t0)
+	if d.blocked("192.0.2.1", t0) {
+		t.Error("logins from before the reset counted")
+	}
+}
+
+func TestStuffingWindow(t *testing.T) {
+	d := newStuffingDetector([]byte("k"), time.Minute, 3, 100, 1000, true)
+	t0 := time.Unix(1000, 0)
+	d.observe("192.0.2.1", "alice", "a", false, t0)
+	d.observe("192.0.2.1", "bob", "a", false, t0)
+	d.observe("192.0.2.1", "carol", "a", false, t0.Add(time.Minute))
+	if d.blocked("192.0.2.1", t0.Add(time.Minute)) {
+		t.Error("counted logins from an earlier window")
+	}
+}
+
+func TestPasswordSpraying(t *testing.T) {
+	d := newStuffingDetector([]byte("k"), time.Minute, 100, 3, 1000, true)
+	t0 := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		d.observe(fmt.Sprintf("192.0.2.%d", i), fmt.Sprintf("user%d", i), "hunter2", false, t0)
+	}
+	for i := 0; i < 3; i++ {
+		if ip := fmt.Sprintf("192.0.2.%d", i); !d.blocked(ip, t0) {
+			t.Errorf("%s not blocked", ip)
+		}
+	}
+	d.observe("192.0.2.9", "user9", "hunter2", false, t0)
+	if !d.blocked("192.0.2.9", t0) {
+		t.Error("late sprayer not blocked")
+	}
+	d.observe("192.0.2.10", "user10", "other", false, t0)
+	if d.blocked("192.0.2.10", t0) {
+		t.Error("other password blocked")
+	}
+	if got := d.flaggedIPs(t0); len(got) != 4 {
+		t.Errorf("flaggedIPs = %v", got)
+	}
+}
+
+func TestStuffingDetectOnly(t *testing.T) {
+	d := newStuffingDetector([]byte("k"), time.Minute, 1, 1, 1000, false)
+	t0 := time.Unix(1000, 0)
+	d.observe("192.0.2.1", "alice", "a", false, t0)
+	if d.blocked("192.0.2.1", t0) {
+		t.Error("blocked with banning off")
+	}
+}
+
+func TestStuffingNoCleartext(t *testing.T) {
+	d := newStuffingDetector([]byte("k"), time.Minute, 100, 100, 1000, true)
+	d.observe("192.0.2.1", "alice", "correct horse", false, time.Unix(1000, 0))
+	for h := range d.byPass {
+		if strings.Contains(string(h[:]), "correct") {
+			t.Error("password stored in clear")
+		}
+	}
+	if d.passwordHash("x") == newStuffingDetector([]byte("other"), 0, 0, 0, 0, false).passwordHash("x") {
+		t.Error("hash does not depend on the key")
+	}
+}
+
+func TestStuffingBounded(t *testing.T) {
+	d := newStuffingDetector([]byte("k"), time.Minute, 100, 100, 50, true)
+	t0 := time.Unix(1000, 0)
+	for i := 0; i < 1000; i++ {
+		d.observe(fmt.Sprintf("10.0.%d.%d", i/256, i%256), "alice", fmt.Sprint(i), false, t0)
+	}
+	if n := len(d.byAddr) + len(d.byPass); n > 50 {
+		t.Errorf("%d keys, max 50", n)
+	}
+}
+
+func TestLoginStuffingBan(t *testing.T) {
+	users := []*User{}
+	for i := 0; i < 5; i++ {
+		users = append(users, &User{ID: i + 1, Login: fmt.Sprintf("user%d", i), password: "pw"})
+	}
+	saved := stuffing
+	stuffing = newStuffingDetector([]byte("k"), time.Minute, 3, 100, 1000, true)
+	defer func() { stuffing = saved }()
+	withLoginEnv(users, func() {
+		for i := 0; i < 3; i++ {
+			if _, err := attemptLogin(loginRequest(fmt.Sprintf("user%d", i), "wrong", "192.0.2.1")); err != ErrWrongPassword {
+				t.Fatalf("attempt %d: %v", i, err)
+			}
+		}
+		if _, err := attemptLogin(loginRequest("user4", "pw", "192.0.2.1")); err != ErrBannedIP {
+			t.Errorf("after fan-out: %v, want %v", err, ErrBannedIP)
+		}
+		if _, err := attemptLogin(loginRequest("user4", "pw", "192.0.2.2")); err != nil {
+			t.Errorf("other address: %v", err)
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// tarpit slows down failed logins from users and addresses that are close
+// to being locked or banned. The delay starts steps failures before the
+// threshold at base and doubles with every further failure up to max. At
+// most slots responses are held at once; beyond that they are rejected
+// straight away instead of piling up goroutines.
+type tarpit struct {
+	base, max time.Duration
+	steps     int
+	slots     chan struct{}
+	rejected  int64 // updated atomically
+}
+
+func newTarpit(base, max time.Duration, steps, slots int) *tarpit {
+	return &tarpit{base: base, max: max, steps: steps, slots: make(chan struct{}, slots)}
+}
+
+// delay returns how long to hold a failed attempt by a user with
+// nameFailures and an address with addrFailures consecutive failures.
+func (t *tarpit) delay(nameFailures, addrFailures int) time.Duration {
+	if t == nil {
+		return 0
+	}
+	k := nameFailures - (UserLockThreshold - t.steps)
+	if n := addrFailures - (IPBanThreshold - t.steps); n > k {
+		k = n
+	}
+	if k <= 0 {
+		return 0
+	}
+	d := t.base
+	for i := 1; i < k && d < t.max; i++ {
+		d *= 2
+	}
+	if d > t.max {
+		d = t.max
+	}
+	return d
+}
+
+// wait holds the caller for d, or until ctx is done. It returns false
+// without waiting when every slot is taken.
+func (t *tarpit) wait(ctx context.Context, d time.Duration) bool {
+	if t == nil || d <= 0 {
+		return true
+	}
+	select {
+	case t.slots <- struct{}{}:
+	default:
+		atomic.AddInt64(&t.rejected, 1)
+		return false
+	}
+	defer func() { <-t.slots }()
+	select {
+	case <-clock.After(d):
+	case <-ctx.Done():
+	}
+	return true
+}
+
+var loginTarpit *tarpit
+
+func initTarpit() {
+	spec := getEnv("ISU4_TARPIT_DELAY", "")
+	if spec == "" {
+		return
+	}
+	base, err := time.ParseDuration(spec)
+	must(err)
+	max, err := time.ParseDuration(getEnv("ISU4_TARPIT_MAX", "5s"))
+	must(err)
+	steps, err := strconv.Atoi(getEnv("ISU4_TARPIT_STEPS", "2"))
+	must(err)
+	slots, err := strconv.Atoi(getEnv("ISU4_TARPIT_SLOTS", "1000"))
+	must(err)
+	loginTarpit = newTarpit(base, max, steps, slots)
+}
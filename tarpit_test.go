@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTarpitDelay(t *testing.T) {
+	savedUser, savedIP := UserLockThreshold, IPBanThreshold
+	UserLockThreshold, IPBanThreshold = 3, 10
+	defer func() { UserLockThreshold, IPBanThreshold = savedUser, savedIP }()
+
+	tp := newTarpit(100*time.Millisecond, time.Second, 2, 10)
+	for _, c := range []struct {
+		name, addr int
+		want       time.Duration
+	}{
+		{0, 0, 0},
+		{1, 7, 0},
+		{2, 0, 100 * time.Millisecond},
+		{3, 0, 200 * time.Millisecond},
+		{0, 9, 100 * time.Millisecond},
+		{3, 9, 200 * time.Millisecond},
+		{4, 0, 400 * time.Millisecond},
+		{10, 0, time.Second},
+		{0, 1000, time.Second},
+	} {
+		if got := tp.delay(c.name, c.addr); got != c.want {
+			t.Errorf("delay(%d, %d) = %v, want %v", c.name, c.addr, got, c.want)
+		}
+	}
+	if d := (*tarpit)(nil).delay(100, 100); d != 0 {
+		t.Errorf("nil tarpit delay = %v", d)
+	}
+}
+
+func TestTarpitWait(t *testing.T) {
+	fc := newFakeClock(time.Unix(1000, 0))
+	withClock(fc, func() {
+		tp := newTarpit(time.Second, time.Second, 1, 1)
+		done := make(chan bool)
+		go func() { done <- tp.wait(context.Background(), time.Second) }()
+		fc.BlockUntil(1)
+
+		// The only slot is taken, so the next caller is turned away at once.
+		if tp.wait(context.Background(), time.Second) {
+			t.Error("waited beyond the cap")
+		}
+		if tp.rejected != 1 {
+			t.Errorf("rejected = %d", tp.rejected)
+		}
+
+		fc.Advance(999 * time.Millisecond)
+		select {
+		case <-done:
+			t.Fatal("released early")
+		case <-time.After(10 * time.Millisecond):
+		}
+		fc.Advance(time.Millisecond)
+		if !<-done {
+			t.Error("wait = false")
+		}
+		if len(tp.slots) != 0 {
+			t.Error("slot not released")
+		}
+	})
+}
+
+func TestTarpitWaitCanceled(t *testing.T) {
+	withClock(newFakeClock(time.Unix(1000, 0)), func() {
+		tp := newTarpit(time.Second, time.Second, 1, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if !tp.wait(ctx, time.Hour) {
+			t.Error("wait = false")
+		}
+		if len(tp.slots) != 0 {
+			t.Error("slot not released")
+		}
+	})
+}
+
+func TestLoginTarpit(t *testing.T) {
+	users := []*User{{ID: 1, Login: "alice", password: "pw"}}
+	fc := newFakeClock(time.Unix(1000, 0))
+	saved := loginTarpit
+	loginTarpit = newTarpit(time.Second, 4*time.Second, 1, 10)
+	defer func() { loginTarpit = saved }()
+	withClock(fc, func() {
+		withLoginEnv(users, func() {
+			post := func() chan int {
+				c := make(chan int)
+				go func() {
+					w := httptest.NewRecorder()
+					login_post(w, loginRequest("alice", "wrong", "192.0.2.1"))
+					c <- w.Code
+				}()
+				return c
+			}
+			// Two failures are let through; the one that reaches the
+			// lock threshold is held.
+			for i := 0; i < 2; i++ {
+				if code := <-post(); code != 302 {
+					t.Fatalf("attempt %d: %d", i, code)
+				}
+			}
+			c := post()
+			fc.BlockUntil(1)
+			select {
+			case <-c:
+				t.Fatal("not held")
+			case <-time.After(10 * time.Millisecond):
+			}
+			fc.Advance(time.Second)
+			if code := <-c; code != 302 {
+				t.Errorf("held attempt: %d", code)
+			}
+			// Now locked, which is answered without holding.
+			select {
+			case code := <-post():
+				if code != 302 {
+					t.Errorf("locked attempt: %d", code)
+				}
+			case <-time.After(time.Second):
+				t.Error("locked attempt held")
+			}
+		})
+	})
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template/parse"
+)
+
+// Pages are rendered from templates/: layout.tmpl wraps every other
+// *.tmpl file, which is parsed as its "content" template. The martini-style
+// {{ yield }} in the layout marks where the content goes.
+//
+// Executing html/template costs several times more than writing the page by
+// hand, so pages whose data is a struct of strings are also precompiled: the
+// template is run once with marker values to find the static text between
+// fields, and rendering only copies that text and escapes the fields. Only
+// templates that use the data as bare {{.X}} and {{if .X}} in HTML text or
+// quoted attributes are precompiled; others are executed as usual.
+
+type page struct {
+	t   *template.Template
+	typ reflect.Type // of the data the variants were compiled for
+	// variants holds one compiled form per combination of empty fields,
+	// indexed by the bitmask of empty fields. nil when the page's data is
+	// not flat or the template did not compile.
+	variants []*compiledPage
+}
+
+type compiledPage struct {
+	chunks [][]byte // static text around the fields
+	fields []int    // struct field written after chunks[i]
+}
+
+// pageData lists the data type of every page that should be precompiled.
+var pageData = map[string]interface{}{
+	"index":          indexPage{},
+	"mypage":         mypagePage{},
+	"error":          errorPageData{},
+	"mfa":            mfaPage{},
+	"mfa_setup":      mfaSetupPage{},
+	"password":       passwordPage{},
+	"password_reset": passwordResetPage{},
+}
+
+// Page data is flattened into strings before rendering: walking pointers
+// and calling methods by reflection is most of what html/template costs.
+type indexPage struct {
+	Notice    string
+	CSRFToken string // empty when CSRF checks are off
+}
+
+type mypagePage struct {
+	At, IP, Login string // of the last login
+	MFA           string // enrollment status, empty when MFA is off
+}
+
+type errorPageData struct {
+	Title, Message string
+}
+
+func newMypagePage(l *LastLogin) mypagePage {
+	return mypagePage{At: l.CreatedAt.Format("2006-01-02 15:04:05"), IP: l.IP, Login: l.Login}
+}
+
+var (
+	templateDir   = "templates"
+	pageTemplates atomic.Value // map[string]*page
+)
+
+func currentTemplates() map[string]*page {
+	pages, _ := pageTemplates.Load().(map[string]*page)
+	return pages
+}
+
+var yieldRe = regexp.MustCompile(`\{\{\s*yield\s*\}\}`)
+
+// parseTemplates parses the templates in dir, linking static files through
+// assets.
+func parseTemplates(dir string, assets map[string]string) (map[string]*page, error) {
+	src, err := os.ReadFile(filepath.Join(dir, "layout.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	layout, err := template.New("layout").Funcs(template.FuncMap{"asset": func(urlpath string) string { return lookupAsset(assets, urlpath) }}).Parse(yieldRe.ReplaceAllLiteralString(string(src), `{{ template "content" . }}`))
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	pages := make(map[string]*page)
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".tmpl")
+		if name == "layout" {
+			continue
+		}
+		src, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		t, err := layout.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := t.New("content").Parse(string(src)); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		p := &page{t: t}
+		if data, ok := pageData[name]; ok {
+			p.typ = reflect.TypeOf(data)
+			if p.variants, err = compilePage(t, p.typ); err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			if p.variants == nil {
+				logger.Warn("template not precompiled", "file", file)
+			}
+		}
+		pages[name] = p
+	}
+	return pages, nil
+}
+
+func initTemplates() {
+	templateDir = getEnv("ISU4_TEMPLATES", templateDir)
+	pages, err := parseTemplates(templateDir, currentAssets())
+	must(err)
+	pageTemplates.Store(pages)
+}
+
+// maxCompiledFields bounds the 2^n variants compilePage builds.
+const maxCompiledFields = 6
+
+// compilePage precompiles t for data of type typ. It returns nil when typ
+// is not a small struct of strings or when t's output does not split
+// cleanly around its fields.
+func compilePage(t *template.Template, typ reflect.Type) ([]*compiledPage, error) {
+	if typ.Kind() != reflect.Struct || typ.NumField() > maxCompiledFields {
+		return nil, nil
+	}
+	for i := 0; i < typ.NumField(); i++ {
+		if f := typ.Field(i); f.Type.Kind() != reflect.String || f.PkgPath != "" {
+			return nil, nil
+		}
+	}
+	// Checked before the first execution, which adds escapers to the trees.
+	for _, tt := range t.Templates() {
+		if tt.Tree != nil && !bareUses(tt.Tree.Root) {
+			return nil, nil
+		}
+	}
+	variants := make([]*compiledPage, 1<<typ.NumField())
+	printed := make([]int, len(variants))
+	for empty := range variants {
+		n, ok := printedFields(t, t.Lookup("layout").Tree.Root, typ, empty, 0)
+		if !ok {
+			return nil, nil
+		}
+		printed[empty] = n
+	}
+	for empty := range variants {
+		a, err := compileVariant(t, typ, empty, "a", printed[empty])
+		if err != nil || a == nil {
+			return nil, err
+		}
+		// Different marker values must give the same text around them, or
+		// the template depends on more than whether a field is empty.
+		b, err := compileVariant(t, typ, empty, "b", printed[empty])
+		if err != nil || b == nil || !reflect.DeepEqual(a, b) {
+			return nil, err
+		}
+		variants[empty] = a
+	}
+	return variants, nil
+}
+
+// bareUses reports whether n uses the data only as {{.X}}, {{if .X}} and
+// {{template "name" .}}. Anything else, such as {{printf "%.3s" .X}} or
+// {{if eq .X "y"}}, depends on more than the escaped value or emptiness of
+// a field, which is all a compiled page knows.
+func bareUses(n parse.Node) bool {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return true
+		}
+		for _, c := range n.Nodes {
+			if !bareUses(c) {
+				return false
+			}
+		}
+		return true
+	case *parse.TextNode, *parse.CommentNode:
+		return true
+	case *parse.ActionNode:
+		return bareField(n.Pipe) || !usesData(n.Pipe)
+	case *parse.IfNode:
+		return (bareField(n.Pipe) || !usesData(n.Pipe)) && bareUses(n.List) && bareUses(n.ElseList)
+	case *parse.TemplateNode:
+		if n.Pipe == nil || !usesData(n.Pipe) {
+			return true
+		}
+		if len(n.Pipe.Decl) > 0 || len(n.Pipe.Cmds) != 1 || len(n.Pipe.Cmds[0].Args) != 1 {
+			return false
+		}
+		_, dot := n.Pipe.Cmds[0].Args[0].(*parse.DotNode)
+		return dot
+	}
+	// range and with change what dot is.
+	return false
+}
+
+// printedFields counts the {{.X}} actions under n that write a non-empty
+// field when the fields in empty are empty, following {{if .X}} and
+// {{template}}. It fails on a condition it cannot decide.
+func printedFields(t *template.Template, n parse.Node, typ reflect.Type, empty, depth int) (int, bool) {
+	field := func(pipe *parse.PipeNode) (int, bool) {
+		f, ok := typ.FieldByName(pipe.Cmds[0].Args[0].(*parse.FieldNode).Ident[0])
+		if !ok {
+			return 0, false
+		}
+		return f.Index[0], true
+	}
+	switch n := n.(type) {
+	case *parse.ListNode:
+		count := 0
+		if n == nil {
+			return 0, true
+		}
+		for _, c := range n.Nodes {
+			k, ok := printedFields(t, c, typ, empty, depth)
+			if !ok {
+				return 0, false
+			}
+			count += k
+		}
+		return count, true
+	case *parse.ActionNode:
+		if !bareField(n.Pipe) {
+			return 0, true
+		}
+		i, ok := field(n.Pipe)
+		if !ok {
+			return 0, false
+		}
+		if empty&(1<<i) != 0 {
+			return 0, true
+		}
+		return 1, true
+	case *parse.IfNode:
+		if !bareField(n.Pipe) {
+			return 0, false
+		}
+		i, ok := field(n.Pipe)
+		if !ok {
+			return 0, false
+		}
+		if empty&(1<<i) != 0 {
+			return printedFields(t, n.ElseList, typ, empty, depth)
+		}
+		return printedFields(t, n.List, typ, empty, depth)
+	case *parse.TemplateNode:
+		tt := t.Lookup(n.Name)
+		if tt == nil || tt.Tree == nil || depth > 10 {
+			return 0, false
+		}
+		return printedFields(t, tt.Tree.Root, typ, empty, depth+1)
+	}
+	return 0, true
+}
+
+// bareField reports whether pipe is just .X.
+func bareField(pipe *parse.PipeNode) bool {
+	if pipe == nil || len(pipe.Decl) > 0 || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return false
+	}
+	f, ok := pipe.Cmds[0].Args[0].(*parse.FieldNode)
+	return ok && len(f.Ident) == 1
+}
+
+// usesData reports whether anything in pipe reads the data or a variable.
+func usesData(pipe *parse.PipeNode) bool {
+	if pipe == nil {
+		return false
+	}
+	if len(pipe.Decl) > 0 {
+		return true
+	}
+	for _, cmd := range pipe.Cmds {
+		for _, arg := range cmd.Args {
+			switch arg := arg.(type) {
+			case *parse.FieldNode, *parse.ChainNode, *parse.VariableNode, *parse.DotNode:
+				return true
+			case *parse.PipeNode:
+				if usesData(arg) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// marker is a field value that html/template escapes differently in every
+// context but HTML text and quoted attributes; the space, "=" and "`" tell
+// unquoted attributes apart.
+func marker(variant string, i int) string {
+	return fmt.Sprintf("isu4marker%s%d\x00\"'&+<> =`", variant, i)
+}
+
+// compileVariant runs t with markers in the fields not in empty and cuts
+// the output at them. printed is how many markers should be found; fewer
+// means a filter replaced a field, as with ZgotmplZ in CSS or attribute
+// names, and the page is not compiled.
+func compileVariant(t *template.Template, typ reflect.Type, empty int, variant string, printed int) (*compiledPage, error) {
+	v := reflect.New(typ).Elem()
+	markers := make([]string, typ.NumField())
+	for i := range markers {
+		if empty&(1<<i) == 0 {
+			v.Field(i).SetString(marker(variant, i))
+			var buf bytes.Buffer
+			htmlEscape(&buf, marker(variant, i))
+			markers[i] = buf.String()
+		}
+	}
+	var out bytes.Buffer
+	if err := t.ExecuteTemplate(&out, "layout", v.Interface()); err != nil {
+		return nil, err
+	}
+	if bytes.Contains(out.Bytes(), []byte("ZgotmplZ")) {
+		return nil, nil
+	}
+	p := &compiledPage{}
+	s := out.String()
+	for {
+		at, field := -1, -1
+		for i, m := range markers {
+			if m == "" {
+				continue
+			}
+			if j := strings.Index(s, m); j >= 0 && (at < 0 || j < at) {
+				at, field = j, i
+			}
+		}
+		if at < 0 {
+			break
+		}
+		p.chunks = append(p.chunks, []byte(s[:at]))
+		p.fields = append(p.fields, field)
+		s = s[at+len(markers[field]):]
+	}
+	p.chunks = append(p.chunks, []byte(s))
+	if len(p.fields) != printed {
+		return nil, nil
+	}
+	for _, c := range p.chunks {
+		if bytes.Contains(c, []byte("isu4marker")) {
+			// A marker was escaped some other way, as in a URL or script.
+			return nil, nil
+		}
+	}
+	return p, nil
+}
+
+// htmlEscape escapes s the way html/template does for HTML text.
+func htmlEscape(buf *bytes.Buffer, s string) {
+	last := 0
+	for i := 0; i < len(s); i++ {
+		var esc string
+		switch s[i] {
+		case 0:
+			esc = "\uFFFD"
+		case '"':
+			esc = "&#34;"
+		case '\'':
+			esc = "&#39;"
+		case '&':
+			esc = "&amp;"
+		case '+':
+			esc = "&#43;"
+		case '<':
+			esc = "&lt;"
+		case '>':
+			esc = "&gt;"
+		default:
+			continue
+		}
+		buf.WriteString(s[last:i])
+		buf.WriteString(esc)
+		last = i + 1
+	}
+	buf.WriteString(s[last:])
+}
+
+func (p *page) execute(buf *bytes.Buffer, data interface{}) error {
+	if v := reflect.ValueOf(data); p.variants != nil && v.IsValid() && v.Type() == p.typ {
+		empty := 0
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).Len() == 0 {
+				empty |= 1 << i
+			}
+		}
+		c := p.variants[empty]
+		for i, f := range c.fields {
+			buf.Write(c.chunks[i])
+			htmlEscape(buf, v.Field(f).String())
+		}
+		buf.Write(c.chunks[len(c.chunks)-1])
+		return nil
+	}
+	return p.t.ExecuteTemplate(buf, "layout", data)
+}
+
+// render writes the page name with data through a pooled buffer, so a
+// failing template never sends half a page.
+func render(w http.ResponseWriter, name string, data interface{}) {
+	renderStatus(w, http.StatusOK, name, data)
+}
+
+func renderStatus(w http.ResponseWriter, status int, name string, data interface{}) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer func() {
+		buf.Reset()
+		bufferPool.Put(buf)
+	}()
+	p := currentTemplates()[name]
+	if p == nil {
+		logger.Error("no such template", "name", name)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := p.execute(buf, data); err != nil {
+		logger.Error("render failed", "name", name, "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func loadTestTemplates(t testing.TB) {
+	pages, err := parseTemplates("templates", currentAssets())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageTemplates.Store(pages)
+}
+
+func renderPage(t testing.TB, name string, data interface{}) string {
+	w := httptest.NewRecorder()
+	render(w, name, data)
+	if w.Code != 200 {
+		t.Fatalf("render %s: %d %s", name, w.Code, w.Body)
+	}
+	return w.Body.String()
+}
+
+func TestRenderEscapes(t *testing.T) {
+	loadTestTemplates(t)
+	body := renderPage(t, "index", indexPage{Notice: "<script>x</script>"})
+	if strings.Contains(body, "<script>") || !strings.Contains(body, "&lt;script&gt;") {
+		t.Errorf("notice not escaped:\n%s", body)
+	}
+	if strings.Contains(renderPage(t, "index", indexPage{}), "notice-message") {
+		t.Error("empty notice rendered")
+	}
+
+	u := &User{LastLogin: &LastLogin{Login: `"><b>`, IP: "192.0.2.1", CreatedAt: time.Date(2014, 9, 27, 10, 0, 0, 0, time.UTC)}}
+	body = renderPage(t, "mypage", newMypagePage(u.LastLogin))
+	if strings.Contains(body, `"><b>`) {
+		t.Errorf("login not escaped:\n%s", body)
+	}
+	for _, want := range []string{`<dd id="last-logined-at">2014-09-27 10:00:00</dd>`, `<dd id="last-logined-ip">192.0.2.1</dd>`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
+
+func TestPrecompiledMatchesTemplate(t *testing.T) {
+	loadTestTemplates(t)
+	for _, c := range []struct {
+		name string
+		data interface{}
+	}{
+		{"index", indexPage{}},
+		{"index", indexPage{Notice: "You're banned."}},
+		{"index", indexPage{"<a href='x'>&+\x00</a>", "tok\"en"}},
+		{"mypage", mypagePage{}},
+		{"mypage", mypagePage{"2014-09-27 10:00:00", "192.0.2.1", "isucon", ""}},
+		{"mypage", mypagePage{"", "::1", `"><script>`, "設定済み"}},
+	} {
+		p := currentTemplates()[c.name]
+		if p.variants == nil {
+			t.Fatalf("%s not precompiled", c.name)
+		}
+		var got, want bytes.Buffer
+		if err := p.execute(&got, c.data); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.t.ExecuteTemplate(&want, "layout", c.data); err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != want.String() {
+			t.Errorf("%s %+v:\n%s\n---\n%s", c.name, c.data, got.String(), want.String())
+		}
+	}
+}
+
+func TestCompilePageFallback(t *testing.T) {
+	type data struct{ A string }
+	for _, src := range []string{
+		`<a href="/?q={{ .A }}">`,
+		`<script>var a = {{ .A }};</script>`,
+		`<input value={{ .A }}>`,
+		`<p style="color: {{ .A }}">`,
+		`<p {{ .A }}="x">`,
+		`{{ printf "%.3s" .A }}`,
+		`{{ if eq .A "x" }}x{{ end }}`,
+		`{{ len .A }}`,
+		`{{ with .A }}{{ . }}{{ end }}`,
+		`{{ $a := .A }}{{ $a }}`,
+		`{{ template "t" .A }}{{ define "t" }}{{ . }}{{ end }}`,
+	} {
+		tmpl := htmltemplate.Must(htmltemplate.New("layout").Parse(src))
+		variants, err := compilePage(tmpl, reflect.TypeOf(data{}))
+		if err != nil || variants != nil {
+			t.Errorf("%s: compiled %v %v", src, variants, err)
+		}
+	}
+}
+
+func TestRenderMissingTemplate(t *testing.T) {
+	loadTestTemplates(t)
+	w := httptest.NewRecorder()
+	render(w, "nope", nil)
+	if w.Code != 500 {
+		t.Errorf("code = %d", w.Code)
+	}
+}
+
+// The pages used to be written from the constants below. The templates must
+// produce the same markup, give or take whitespace.
+
+func renderIndexConstants(w http.ResponseWriter, notice string) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.WriteString(index_header)
+	if notice != "" {
+		buf.WriteString(`<div id="notice-message" class="alert alert-danger" role="alert">`)
+		template.HTMLEscape(buf, []byte(notice))
+		buf.WriteString("</div>\n")
+	}
+	buf.WriteString(index_footer)
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+func renderMypageConstants(w http.ResponseWriter, u *User) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.WriteString(mypage_header)
+	fmt.Fprintf(buf, `
+  <dd id="last-logined-at">%s</dd>
+  <dt>最終ログインIPアドレス</dt>
+  <dd id="last-logined-ip">%s</dd>
+</dl>
+
+<div class="panel panel-default">
+  <div class="panel-heading">
+    お客様ご契約ID：%s 様の代表口座
+`, u.LastLogin.CreatedAt.Format("2006-01-02 15:04:05"), u.LastLogin.IP, template.HTMLEscapeString(u.LastLogin.Login))
+	buf.WriteString(mypage_footer)
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+var benchUser = &User{LastLogin: &LastLogin{Login: "isucon", IP: "192.0.2.1", CreatedAt: time.Date(2014, 9, 27, 10, 0, 0, 0, time.UTC)}}
+
+func TestTemplatesMatchConstants(t *testing.T) {
+	// The constants link to the plain asset names.
+	saved := assetURLs.Load()
+	assetURLs.Store(map[string]string{})
+	defer assetURLs.Store(saved)
+	loadTestTemplates(t)
+	same := func(name, got, want string) {
+		if strings.Join(strings.Fields(got), " ") != strings.Join(strings.Fields(want), " ") {
+			t.Errorf("%s differs:\n%s\n---\n%s", name, got, want)
+		}
+	}
+	for _, notice := range []string{"", "Wrong username or password"} {
+		w := httptest.NewRecorder()
+		renderIndexConstants(w, notice)
+		same("index", renderPage(t, "index", indexPage{Notice: notice}), w.Body.String())
+	}
+	w := httptest.NewRecorder()
+	renderMypageConstants(w, benchUser)
+	same("mypage", renderPage(t, "mypage", newMypagePage(benchUser.LastLogin)), w.Body.String())
+}
+
+type discardWriter struct{ h http.Header }
+
+func (w discardWriter) Header() http.Header         { return w.h }
+func (w discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardWriter) WriteHeader(int)             {}
+
+func BenchmarkIndexTemplate(b *testing.B) {
+	loadTestTemplates(b)
+	w := discardWriter{http.Header{}}
+	data := indexPage{Notice: "Wrong username or password"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		render(w, "index", data)
+	}
+}
+
+func BenchmarkIndexConstants(b *testing.B) {
+	w := discardWriter{http.Header{}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		renderIndexConstants(w, "Wrong username or password")
+	}
+}
+
+func BenchmarkMypageTemplate(b *testing.B) {
+	loadTestTemplates(b)
+	w := discardWriter{http.Header{}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		render(w, "mypage", newMypagePage(benchUser.LastLogin))
+	}
+}
+
+func BenchmarkMypageConstants(b *testing.B) {
+	w := discardWriter{http.Header{}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		renderMypageConstants(w, benchUser)
+	}
+}
+
+const index_header = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="UTF-8">
+    <link rel="stylesheet" href="/stylesheets/bootstrap.min.css">
+    <link rel="stylesheet" href="/stylesheets/bootflat.min.css">
+    <link rel="stylesheet" href="/stylesheets/isucon-bank.css">
+    <title>isucon4</title>
+  </head>
+  <body>
+    <div class="container">
+      <h1 id="topbar">
+        <a href="/"><img src="/images/isucon-bank.png" alt="いすこん銀行 オンラインバンキングサービス"></a>
+      </h1>
+<div id="be-careful-phising" class="panel panel-danger">
+  <div class="panel-heading">
+    <span class="hikaru-mozi">偽画面にご注意ください！</span>
+  </div>
+  <div class="panel-body">
+    <p>偽のログイン画面を表示しお客様の情報を盗み取ろうとする犯罪が多発しています。</p>
+    <p>ログイン直後にダウンロード中や、見知らぬウィンドウが開いた場合、<br>すでにウィルスに感染している場合がございます。即座に取引を中止してください。</p>
+    <p>また、残高照会のみなど、必要のない場面で乱数表の入力を求められても、<br>絶対に入力しないでください。</p>
+  </div>
+</div>
+
+<div class="page-header">
+  <h1>ログイン</h1>
+</div>
+`
+
+const index_footer = `
+<div class="container">
+  <form class="form-horizontal" role="form" action="/login" method="POST">
+    <div class="form-group">
+      <label for="input-username" class="col-sm-3 control-label">お客様ご契約ID</label>
+      <div class="col-sm-9">
+        <input id="input-username" type="text" class="form-control" placeholder="半角英数字" name="login">
+      </div>
+    </div>
+    <div class="form-group">
+      <label for="input-password" class="col-sm-3 control-label">パスワード</label>
+      <div class="col-sm-9">
+        <input type="password" class="form-control" id="input-password" name="password" placeholder="半角英数字・記号（２文字以上）">
+      </div>
+    </div>
+    <div class="form-group">
+      <div class="col-sm-offset-3 col-sm-9">
+        <button type="submit" class="btn btn-primary btn-lg btn-block">ログイン</button>
+      </div>
+    </div>
+  </form>
+</div>
+    </div>
+
+  </body>
+</html>
+`
+
+const mypage_header = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="UTF-8">
+    <link rel="stylesheet" href="/stylesheets/bootstrap.min.css">
+    <link rel="stylesheet" href="/stylesheets/bootflat.min.css">
+    <link rel="stylesheet" href="/stylesheets/isucon-bank.css">
+    <title>isucon4</title>
+  </head>
+  <body>
+    <div class="container">
+      <h1 id="topbar">
+        <a href="/"><img src="/images/isucon-bank.png" alt="いすこん銀行 オンラインバンキングサービス"></a>
+      </h1>
+<div class="alert alert-success" role="alert">
+  ログインに成功しました。<br>
+  未読のお知らせが０件、残っています。
+</div>
+
+<dl class="dl-horizontal">
+  <dt>前回ログイン</dt>
+`
+
+const mypage_footer = `
+  </div>
+  <div class="panel-body">
+    <div class="row">
+      <div class="col-sm-4">
+        普通預金<br>
+        <small>東京支店　1111111111</small><br>
+      </div>
+      <div class="col-sm-4">
+        <p id="zandaka" class="text-right">
+          ―――円
+        </p>
+      </div>
+
+      <div class="col-sm-4">
+        <p>
+          <a class="btn btn-success btn-block">入出金明細を表示</a>
+          <a class="btn btn-default btn-block">振込・振替はこちらから</a>
+        </p>
+      </div>
+
+      <div class="col-sm-12">
+        <a class="btn btn-link btn-block">定期預金・住宅ローンのお申込みはこちら</a>
+      </div>
+      <div class="col-sm-12">
+        <a id="password-change" class="btn btn-link btn-block" href="/mypage/password">パスワードの変更</a>
+      </div>
+    </div>
+  </div>
+</div>
+    </div>
+
+  </body>
+</html>
+`
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// When ISU4_TLS_CERT and ISU4_TLS_KEY are set the public site is served over
+// HTTPS on ISU4_TLS_ADDR (default :443) with HTTP/2, and :80 only redirects
+// to it. The certificate is reloaded when either file changes or on SIGHUP,
+// so renewals need no restart.
+var (
+	tlsEnabled   bool
+	tlsAddr      string
+	cookieSecure bool
+	certs        *certReloader
+)
+
+// certReloader hands out the current certificate. Files are checked for
+// changes at most once per checkInterval.
+type certReloader struct {
+	certFile, keyFile string
+	checkInterval     time.Duration
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, checkInterval: time.Second}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reload reads the key pair. A pair that fails to load leaves the current
+// certificate in use.
+func (r *certReloader) reload() error {
+	certMod, keyMod := modTime(r.certFile), modTime(r.keyFile)
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert, r.certMod, r.keyMod = &cert, certMod, keyMod
+	r.mu.Unlock()
+	logger.Info("loaded TLS certificate", "cert", r.certFile)
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	now := clock.Now()
+	r.mu.Lock()
+	check := now.Sub(r.lastCheck) >= r.checkInterval
+	if check {
+		r.lastCheck = now
+	}
+	certMod, keyMod := r.certMod, r.keyMod
+	r.mu.Unlock()
+	if check && (!modTime(r.certFile).Equal(certMod) || !modTime(r.keyFile).Equal(keyMod)) {
+		if err := r.reload(); err != nil {
+			logger.Error("reload TLS certificate", "err", err)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+func newTLSConfig(r *certReloader) *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+func initTLS() {
+	certFile, keyFile := getEnv("ISU4_TLS_CERT", ""), getEnv("ISU4_TLS_KEY", "")
+	if certFile == "" && keyFile == "" {
+		return
+	}
+	var err error
+	certs, err = newCertReloader(certFile, keyFile)
+	must(err)
+	onSIGHUP(func() {
+		if err := certs.reload(); err != nil {
+			logger.Error("reload TLS certificate", "err", err)
+		}
+	})
+	tlsEnabled, cookieSecure = true, true
+	tlsAddr = getEnv("ISU4_TLS_ADDR", ":443")
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL on the TLS
+// listener.
+func redirectToHTTPS(w http.ResponseWriter, req *http.Request) {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	if _, port, _ := net.SplitHostPort(tlsAddr); port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	code := http.StatusMovedPermanently
+	if req.Method != "GET" && req.Method != "HEAD" {
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), code)
+}
+
+func serveTLS(h http.Handler) {
+	go func() {
+		logger.Info("starting HTTPS redirect", "addr", ":80")
+		log.Fatal(http.ListenAndServe(":80", accessLog(http.HandlerFunc(redirectToHTTPS))))
+	}()
+	srv := &http.Server{Addr: tlsAddr, Handler: h, TLSConfig: newTLSConfig(certs)}
+	logger.Info("starting", "addr", tlsAddr, "tls", true)
+	log.Fatal(srv.ListenAndServeTLS("", ""))
+}
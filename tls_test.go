@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for 127.0.0.1 with the given
+// serial number to dir and returns it.
+func writeCert(t *testing.T, dir string, serial int64) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	must(os.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	must(os.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func serial(t *testing.T, r *certReloader) int64 {
+	t.Helper()
+	c, err := r.GetCertificate(nil)
+	if err != nil || c == nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.Int64()
+}
+
+// touch moves a file's modification time forward so a rewrite within the
+// same clock tick is still noticed.
+func touch(path string, d time.Duration) {
+	info, err := os.Stat(path)
+	must(err)
+	must(os.Chtimes(path, info.ModTime().Add(d), info.ModTime().Add(d)))
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, dir, 1)
+	fc := newFakeClock(time.Unix(1000, 0))
+	withClock(fc, func() {
+		r, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := serial(t, r); got != 1 {
+			t.Fatalf("serial %d", got)
+		}
+
+		writeCert(t, dir, 2)
+		touch(certFile, time.Minute)
+		touch(keyFile, time.Minute)
+		if got := serial(t, r); got != 1 {
+			t.Errorf("reloaded before the check interval: %d", got)
+		}
+		fc.Advance(time.Second)
+		if got := serial(t, r); got != 2 {
+			t.Errorf("not reloaded on change: %d", got)
+		}
+
+		// A broken pair keeps the old certificate.
+		must(os.WriteFile(keyFile, []byte("garbage"), 0600))
+		touch(keyFile, 2*time.Minute)
+		fc.Advance(time.Second)
+		if got := serial(t, r); got != 2 {
+			t.Errorf("broken key: serial %d", got)
+		}
+		if err := r.reload(); err == nil {
+			t.Error("reload of a broken pair succeeded")
+		}
+
+		// SIGHUP reloads without waiting for the interval.
+		writeCert(t, dir, 3)
+		if err := r.reload(); err != nil {
+			t.Fatal(err)
+		}
+		if got := serial(t, r); got != 3 {
+			t.Errorf("after reload: serial %d", got)
+		}
+	})
+}
+
+func TestTLSServerHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	cert := writeCert(t, dir, 1)
+	r, err := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Served the way serveTLS does it, not through httptest, which would
+	// install its own certificate.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:   withSecurityHeaders(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})),
+		TLSConfig: newTLSConfig(r),
+	}
+	go srv.ServeTLS(l, "", "")
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("proto = %s", resp.Proto)
+	}
+	if resp.Header.Get("Strict-Transport-Security") == "" {
+		t.Error("no HSTS over TLS")
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	saved := tlsAddr
+	defer func() { tlsAddr = saved }()
+	for _, c := range []struct {
+		addr, method, url string
+		code              int
+		location          string
+	}{
+		{":443", "GET", "http://example.com/mypage?x=1", 301, "https://example.com/mypage?x=1"},
+		{":443", "POST", "http://example.com:80/login", 308, "https://example.com/login"},
+		{":8443", "GET", "http://example.com/", 301, "https://example.com:8443/"},
+	} {
+		tlsAddr = c.addr
+		w := httptest.NewRecorder()
+		redirectToHTTPS(w, httptest.NewRequest(c.method, c.url, nil))
+		if w.Code != c.code || w.Header().Get("Location") != c.location {
+			t.Errorf("%s %s: %d %s", c.method, c.url, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestSecureCookieWithTLS(t *testing.T) {
+	saved := cookieSecure
+	defer func() { cookieSecure = saved }()
+	for _, secure := range []bool{false, true} {
+		cookieSecure = secure
+		w := httptest.NewRecorder()
+		sessionStore.Set(w, &Session{})
+		if got := w.Result().Cookies()[0].Secure; got != secure {
+			t.Errorf("cookieSecure %v: Secure = %v", secure, got)
+		}
+	}
+}
@@ -1,19 +1,24 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/csv"
 	"log"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 )
 
 type User struct {
 	ID           int
 	Login        string
-	PasswordHash string
+	PasswordHash string // with Salt, set once the password has been changed
 	Salt         string
-	password     string
+	HashScheme   string // of PasswordHash, see hashPassword
+	password     string // from dummy_users.tsv
+
+	passMu sync.RWMutex // guards PasswordHash, Salt, HashScheme and password
 
 	LastLogin *LastLogin
 }
@@ -44,6 +49,24 @@ func (r *UserRepository) ById(id int) *User {
 	return r.userById[id]
 }
 
+// checkPassword may take a while for a changed password, so callers keep
+// it out of any lock others wait on.
+func (u *User) checkPassword(password string) bool {
+	u.passMu.RLock()
+	scheme, hash, salt, plain := u.HashScheme, u.PasswordHash, u.Salt, u.password
+	u.passMu.RUnlock()
+	if hash != "" {
+		return subtle.ConstantTimeCompare([]byte(hashPassword(scheme, password, salt)), []byte(hash)) == 1
+	}
+	return plain == password
+}
+
+func (u *User) setPasswordHash(scheme, hash, salt string) {
+	u.passMu.Lock()
+	u.HashScheme, u.PasswordHash, u.Salt, u.password = scheme, hash, salt, ""
+	u.passMu.Unlock()
+}
+
 type LastLogin struct {
 	Login     string
 	IP        string
@@ -51,24 +74,9 @@ type LastLogin struct {
 }
 
 func (u *User) getLastLogin() *LastLogin {
-	hist := loginHistory.ByName(u.Login)
+	// The most recent success is the current login; show the one before.
+	l := loginHistory.ByName(u.Login).prev
 	u.LastLogin = &LastLogin{}
-	if hist == nil || len(hist) < 2 {
-		return nil
-	}
-
-	var l *UserLogin = nil
-	current := false
-	for i := len(hist) - 1; i >= 0; i-- {
-		if !hist[i].Success {
-			continue
-		}
-		if current {
-			l = hist[i]
-			break
-		}
-		current = true
-	}
 	if l == nil {
 		return nil
 	}
@@ -6,6 +6,10 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
 )
 
 func getEnv(key string, def string) string {
@@ -24,8 +28,59 @@ func calcPassHash(password, hash string) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
+// writeFileAtomic replaces path atomically.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
 func must(err error) {
 	if err != nil {
 		log.Panic(err)
 	}
 }
+
+var (
+	hupMu       sync.Mutex
+	hupHandlers []func()
+)
+
+// onSIGHUP registers f to run whenever the process receives SIGHUP.
+func onSIGHUP(f func()) {
+	hupMu.Lock()
+	hupHandlers = append(hupHandlers, f)
+	hupMu.Unlock()
+}
+
+// notifySIGHUP catches SIGHUP from now on. It is called before setup, so a
+// SIGHUP during startup does not kill the process; it is handled once
+// handleSIGHUP runs.
+func notifySIGHUP() chan os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	return c
+}
+
+func handleSIGHUP(c chan os.Signal) {
+	for range c {
+		logger.Info("SIGHUP received, reloading")
+		hupMu.Lock()
+		handlers := append([]func(){}, hupHandlers...)
+		hupMu.Unlock()
+		for _, f := range handlers {
+			f()
+		}
+	}
+}